@@ -37,6 +37,22 @@ func metadataFromString(message string) (title string, meta string, body string)
 	return groups[1], groups[2], body
 }
 
+// mergeMetadata combines comma separated metadata values, dropping duplicates.
+func mergeMetadata(metas ...string) string {
+	var values []string
+	seen := map[string]bool{}
+	for _, meta := range metas {
+		for _, value := range strings.Split(meta, ",") {
+			value = strings.TrimSpace(value)
+			if len(value) > 0 && !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+		}
+	}
+	return strings.Join(values, ",")
+}
+
 func metadataToString(title string, meta string, body string) (message string) {
 	message = title
 	if len(meta) > 0 {
@@ -73,6 +89,7 @@ func RegisterMetaCLI(p *kingpin.Application) {
 	// Set
 	c = cli.Command("set", "Add metadata to commit..").
 		Alias("s").
+		PreAction(recordOperation).
 		Action(cli.doMetaSet)
 
 	c.Arg("value", "Value of the arg to set.").
@@ -82,6 +99,7 @@ func RegisterMetaCLI(p *kingpin.Application) {
 	// Clear
 	c = cli.Command("clear", "Clear metadata from commit.").
 		Alias("d").
+		PreAction(recordOperation).
 		Action(cli.doMetaClear)
 
 	// View
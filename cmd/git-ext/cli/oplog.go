@@ -0,0 +1,303 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// operation is a snapshot of HEAD, the stack labels and the local branches taken right before
+// a command that rewrites history or refs, so that the command can be undone.
+type operation struct {
+	ID      int               `json:"id"`
+	Time    time.Time         `json:"time"`
+	Command string            `json:"command"`
+	Head    string            `json:"head"`
+	Branch  string            `json:"branch,omitempty"`
+	Refs    map[string]string `json:"refs"`
+
+	// Branches are the other local branches, which commands such as uplift and import
+	// update or create.
+	Branches map[string]string `json:"branches,omitempty"`
+}
+
+type oplogCLI struct {
+	undoOperationID int
+	oplogLimit      int
+}
+
+func RegisterOplogCLI(p *kingpin.Application) {
+	cli := &oplogCLI{}
+	var c *kingpin.CmdClause
+
+	// Undo
+	c = p.Command("undo", "Restore HEAD, the stack labels and the branches to how they were before an operation.").
+		PreAction(recordOperation).
+		Action(cli.doUndo)
+	c.Arg("id", "Operation to undo, defaults to the last one.").
+		IntVar(&cli.undoOperationID)
+
+	// Oplog
+	c = p.Command("oplog", "List the recorded operations.").
+		Action(cli.doOplog)
+	c.Flag("limit", "Number of operations to show.").Short('n').
+		Default("20").
+		IntVar(&cli.oplogLimit)
+
+	// NoQA:
+	_ = c
+}
+
+// recordOperation appends a snapshot of the current state to the operation log. It is used as
+// the PreAction of every command that rewrites history or refs.
+func recordOperation(ctx *kingpin.ParseContext) error {
+	op, err := snapshotOperation()
+	clitools.UserError(err)
+
+	ops, err := readOplog()
+	clitools.UserError(err)
+	if len(ops) > 0 {
+		op.ID = ops[len(ops)-1].ID + 1
+	}
+	op.Command = strings.Join(append([]string{"git-ext"}, os.Args[1:]...), " ")
+
+	logPath, err := extDataPath("oplog")
+	clitools.UserError(err)
+
+	raw, err := json.Marshal(op)
+	clitools.UserError(err)
+
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	clitools.UserError(err)
+	defer logFile.Close()
+
+	_, err = fmt.Fprintln(logFile, string(raw))
+	clitools.UserError(err)
+	return nil
+}
+
+func (cli *oplogCLI) doUndo(ctx *kingpin.ParseContext) error {
+	if git.IsRebaseInProgress() {
+		clitools.UserErrorStr("Undo", "a rebase is in progress, finish or abort it first")
+	}
+
+	ops, err := readOplog()
+	clitools.UserError(err)
+
+	// The last entry is the snapshot recorded for this very undo.
+	ops = ops[:len(ops)-1]
+	if len(ops) == 0 {
+		clitools.UserErrorStr("Undo", "there are no recorded operations")
+	}
+
+	op := ops[len(ops)-1]
+	if cli.undoOperationID > 0 {
+		found := false
+		for _, candidate := range ops {
+			if candidate.ID == cli.undoOperationID {
+				op, found = candidate, true
+			}
+		}
+		if !found {
+			clitools.UserErrorStr("Undo", "there is no operation %d", cli.undoOperationID)
+		}
+	}
+
+	fmt.Printf("Undoing #%d: %v\n", op.ID, op.Command)
+	clitools.UserError(restoreOperation(op))
+	return nil
+}
+
+func (cli *oplogCLI) doOplog(ctx *kingpin.ParseContext) error {
+	ops, err := readOplog()
+	clitools.UserError(err)
+
+	for idx := len(ops) - 1; idx >= 0 && idx >= len(ops)-cli.oplogLimit; idx-- {
+		op := ops[idx]
+		head := op.Head[:7]
+		if op.Branch != "" {
+			head = fmt.Sprintf("%v (%v)", head, op.Branch)
+		}
+		fmt.Printf("#%-4d %v  %v\n      %v\n", op.ID, op.Time.Format("2006-01-02 15:04:05"), head, op.Command)
+	}
+	return nil
+}
+
+// snapshotOperation captures HEAD, the checked out branch, all stack labels and the other
+// local branches.
+func snapshotOperation() (*operation, error) {
+	head, err := git.GetSha("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	branch, _ := git.GetCurrentBranch()
+
+	refs, err := listLabelRefs()
+	if err != nil {
+		return nil, err
+	}
+	if branch != "" {
+		refs["refs/heads/"+branch] = head
+	}
+	branches, err := listOtherBranchRefs(branch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &operation{
+		Time:     time.Now(),
+		Head:     head,
+		Branch:   branch,
+		Refs:     refs,
+		Branches: branches,
+	}, nil
+}
+
+// listOtherBranchRefs returns the full refs of the local branches other than the labels and
+// the current branch, and what they point at.
+func listOtherBranchRefs(current string) (map[string]string, error) {
+	refs, err := git.ListRefs("refs/heads/")
+	if err != nil {
+		return nil, err
+	}
+
+	branches := map[string]string{}
+	for ref, sha := range refs {
+		name := strings.TrimPrefix(ref, "refs/heads/")
+		if name != current && !isLabelBranch(name) {
+			branches[ref] = sha
+		}
+	}
+	return branches, nil
+}
+
+// listLabelRefs returns the full refs of the labels of all stacks and what they point at.
+func listLabelRefs() (map[string]string, error) {
+	labels := map[string]string{}
+
+	branches, err := git.ListRefs("refs/heads/" + labelPrefix())
+	if err != nil {
+		return nil, err
+	}
+	for ref, sha := range branches {
+		if isLabelBranch(strings.TrimPrefix(ref, "refs/heads/")) {
+			labels[ref] = sha
+		}
+	}
+
+	hidden, err := git.ListRefs("refs/" + hiddenLabelPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for ref, sha := range hidden {
+		labels[ref] = sha
+	}
+	return labels, nil
+}
+
+// restoreOperation checks out the recorded HEAD, keeping local changes, and resets the stack
+// labels and the other branches to the recorded ones. Branches created since are deleted,
+// their tips are printed so they can be recovered.
+func restoreOperation(op operation) error {
+	if op.Branch != "" {
+		current, _ := git.GetCurrentBranch()
+		if current != op.Branch {
+			err := git.Cmd("checkout", op.Branch).PipeStderr(os.Stderr).Run().Err()
+			if err != nil {
+				return err
+			}
+		}
+		err := git.Cmd("reset", "--keep", op.Head).PipeStderr(os.Stderr).Run().Err()
+		if err != nil {
+			return err
+		}
+	} else {
+		err := git.Cmd("checkout", "--detach", op.Head).PipeStderr(os.Stderr).Run().Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	current, err := listLabelRefs()
+	if err != nil {
+		return err
+	}
+	for ref := range current {
+		if _, ok := op.Refs[ref]; !ok {
+			fmt.Printf("Removing label: %v\n", ref)
+			if err := git.RawDeleteRef(ref).Run().Err(); err != nil {
+				return err
+			}
+		}
+	}
+	for ref, sha := range op.Refs {
+		if ref == "refs/heads/"+op.Branch || current[ref] == sha {
+			continue
+		}
+		fmt.Printf("Restoring label: %v -> %v\n", ref, sha[:7])
+		if err := git.RawSetRef(ref, sha).Run().Err(); err != nil {
+			return err
+		}
+	}
+
+	// Operations recorded before branches were tracked leave them alone.
+	if op.Branches == nil {
+		return nil
+	}
+	branches, err := listOtherBranchRefs(op.Branch)
+	if err != nil {
+		return err
+	}
+	for ref, sha := range branches {
+		if _, ok := op.Branches[ref]; !ok && ref != "refs/heads/"+op.Branch {
+			fmt.Printf("Deleting branch: %v (was %v)\n", strings.TrimPrefix(ref, "refs/heads/"), sha[:7])
+			if err := git.RawUnSetBranch(strings.TrimPrefix(ref, "refs/heads/"), true).Run().Err(); err != nil {
+				return err
+			}
+		}
+	}
+	for ref, sha := range op.Branches {
+		if branches[ref] == sha {
+			continue
+		}
+		fmt.Printf("Restoring branch: %v -> %v\n", strings.TrimPrefix(ref, "refs/heads/"), sha[:7])
+		if err := git.RawSetRef(ref, sha).Run().Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readOplog() ([]operation, error) {
+	logPath, err := extDataPath("oplog")
+	if err != nil {
+		return nil, err
+	}
+
+	logFile, err := os.Open(logPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+
+	var ops []operation
+	scanner := bufio.NewScanner(logFile)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var op operation
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, scanner.Err()
+}
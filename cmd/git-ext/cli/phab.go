@@ -125,7 +125,11 @@ func (cli *phabCLI) doDiff(diffUpdate string, extraFlags []string) error {
 		updateRev = diffUpdate
 	}
 
-	return arc.Diff("git:HEAD^1", updateRev, extraFlags)
+	err := arc.Diff("git:HEAD^1", updateRev, extraFlags)
+	if err != nil {
+		return err
+	}
+	return snapshotStack("phab diff")
 }
 
 func (cli *phabCLI) doDiffMessagePrint(revisionID string) error {
@@ -2,36 +2,79 @@ package cli
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
-	"regexp"
+	"path"
 	"strings"
 
 	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/rebasetodo"
 	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
-const (
-	branchLabelPrefix = "D/"
-)
-
-var branchPattern = regexp.MustCompile(`D/\d+`)
-var branchFormat = "D/%02d"
-
 type stackCLI struct {
 	kingpin.CmdClause
 
 	upstreamOverride string
 
-	rebaseEditPrefix string
-	rebaseEditFile   string
+	rebaseEditPrefix        string
+	rebaseEditFile          string
+	rebaseEditAction        string
+	rebaseEditAmendFromFile string
+	rebaseEditMoveBefore    string
+	rebaseEditMoveAfter     string
 
 	editTargetRef string
 
+	splitTargetRef string
+	splitPathGlobs []string
+
+	foldTargetRef string
+	foldMode      string
+
+	moveTargetRef string
+	moveBeforeRef string
+	moveAfterRef  string
+
 	rebaseExtraArgs []string
 
 	labelDeleteBranches bool
+	labelStable         bool
+	labelHidden         bool
+	labelMigrate        bool
+
+	listJSONFlag bool
+
+	execCommandArgs []string
+	execKeepGoing   bool
+	execJSONFlag    bool
+	execNoCache     bool
+
+	rangeDiffOld string
+	rangeDiffNew string
+
+	exportOut    string
+	exportMbox   bool
+	exportSeries bool
+
+	importSource          string
+	importBranch          string
+	importDetachRevisions bool
+
+	amendTargetRef string
+
+	dropTargetRef string
+	dropAbandon   bool
+
+	upliftTargetRef string
+	upliftTo        string
+
+	rewordTargetRef string
+	rewordMessage   string
+	rewordEdit      bool
+	rewordKeepMeta  bool
+	rewordAll       bool
+	rewordStrict    bool
 
 	metaGetFlag   bool
 	metaPutFlag   bool
@@ -50,6 +93,15 @@ func RegisterStackCLI(p *kingpin.Application) {
 	c.Flag("branchLabelPrefix", "Target SHA branchLabelPrefix to mark for edits.").
 		Required().
 		StringVar(&cli.rebaseEditPrefix)
+	c.Flag("action", "Action to set for the target SHA.").
+		Default("edit").
+		EnumVar(&cli.rebaseEditAction, rebasetodo.Pick, rebasetodo.Reword, rebasetodo.Edit, rebasetodo.Fixup, rebasetodo.Squash, rebasetodo.Drop)
+	c.Flag("amend-from-file", "Amend the message of the commit after the target SHA from the file.").
+		StringVar(&cli.rebaseEditAmendFromFile)
+	c.Flag("move-before", "Move the target SHA before the commit with this SHA prefix.").
+		StringVar(&cli.rebaseEditMoveBefore)
+	c.Flag("move-after", "Move the target SHA after the commit with this SHA prefix.").
+		StringVar(&cli.rebaseEditMoveAfter)
 	c.Arg("file", "Rebase file to read and overwrite.").
 		Required().
 		ExistingFileVar(&cli.rebaseEditFile)
@@ -57,73 +109,272 @@ func RegisterStackCLI(p *kingpin.Application) {
 	// Edit
 	c = cli.Command("edit", "Launch interactive rebase session to edit a given commit from history.").
 		Alias("e").
+		PreAction(recordOperation).
 		Action(cli.doEdit)
-	c.Arg("target", "Target commit sha or ref to edit in rebase session.").
+	c.Arg("target", "Target commit sha, ref or label number to edit in rebase session.").
 		Required().
-		HintAction(func() (choices []string) {
-			branches, _ := git.ListBranches()
-			for _, branch := range branches {
-				if strings.HasPrefix(branch, branchLabelPrefix) {
-					choices = append(choices, branch)
-				}
-			}
-			return
-		}).
+		HintAction(labelHints).
 		StringVar(&cli.editTargetRef)
 
+	// Split
+	c = cli.Command("split", "Split a commit from history into one commit per group of paths.").
+		PreAction(recordOperation).
+		Action(cli.doSplit)
+	c.Arg("target", "Target commit sha, ref, label number or a part of its title.").
+		Required().
+		HintAction(labelHints).
+		StringVar(&cli.splitTargetRef)
+	c.Arg("globs", "Path globs, one argument per new commit (comma separated globs are grouped). Remaining paths go into a final commit.").
+		Required().
+		StringsVar(&cli.splitPathGlobs)
+
 	c = cli.Command("rebase", "Launch interactive rebase session against upstream.").
 		Alias("rb").
+		PreAction(recordOperation).
 		Action(cli.doRebase)
 	c.Arg("args", "Extra args to pass to `git rebase`, example `rebase -- -x 'make build'`").
 		StringsVar(&cli.rebaseExtraArgs)
 
+	// List
+	c = cli.Command("list", "List the commits on the stack.").
+		Alias("ls").
+		Action(cli.doList)
+	c.Flag("json", "Print the stack as JSON.").
+		BoolVar(&cli.listJSONFlag)
+
+	// Sync
+	c = cli.Command("sync", "Rebase the stack onto the current upstream and move the labels along.").
+		PreAction(recordOperation).
+		Action(cli.doSync)
+
+	// Navigation
+	c = cli.Command("next", "Check out the commit above HEAD, or step an ongoing rebase forward by one commit.").
+		Alias("n").
+		Action(cli.doNext)
+	c = cli.Command("prev", "Check out the commit below HEAD.").
+		Alias("p").
+		Action(cli.doPrev)
+	c = cli.Command("top", "Check out the top of the stack, or run an ongoing rebase to completion.").
+		Action(cli.doTop)
+	c = cli.Command("bottom", "Check out the bottom of the stack.").
+		Action(cli.doBottom)
+
+	// Fold
+	c = cli.Command("fold", "Fold a commit from history into its parent, combining their metadata.").
+		Alias("squash").
+		PreAction(recordOperation).
+		Action(cli.doFold)
+	c.Arg("target", "Target commit sha or ref to fold into its parent.").
+		Required().
+		HintAction(labelHints).
+		StringVar(&cli.foldTargetRef)
+	c.Flag("mode", "Either keep only the parent message (fixup) or append the target message to it (squash).").
+		Default("fixup").
+		EnumVar(&cli.foldMode, "fixup", "squash")
+
+	// Move
+	c = cli.Command("move", "Move a commit from history before or after another commit of the stack.").
+		Alias("mv").
+		PreAction(recordOperation).
+		Action(cli.doMove)
+	c.Arg("target", "Target commit sha or ref to move.").
+		Required().
+		HintAction(labelHints).
+		StringVar(&cli.moveTargetRef)
+	c.Flag("before", "Commit sha or ref to move the target before.").
+		HintAction(labelHints).
+		StringVar(&cli.moveBeforeRef)
+	c.Flag("after", "Commit sha or ref to move the target after.").
+		HintAction(labelHints).
+		StringVar(&cli.moveAfterRef)
+
+	// Absorb
+	c = cli.Command("absorb", "Absorb staged changes into the stack commits that last touched the same lines.").
+		PreAction(recordOperation).
+		Action(cli.doAbsorb)
+
+	// Amend
+	c = cli.Command("amend", "Fold the staged changes into a commit of the stack, without opening an editor.").
+		PreAction(recordOperation).
+		Action(cli.doAmend)
+	c.Arg("target", "Target commit sha, ref, label number or a part of its title.").
+		Required().
+		HintAction(labelHints).
+		StringVar(&cli.amendTargetRef)
+
+	// Drop
+	c = cli.Command("drop", "Drop a commit from the stack, optionally abandoning its revision.").
+		PreAction(recordOperation).
+		Action(cli.doDrop)
+	c.Arg("target", "Target commit sha, ref, label number or a part of its title.").
+		Required().
+		HintAction(labelHints).
+		StringVar(&cli.dropTargetRef)
+	c.Flag("abandon", "Abandon the Phabricator revision of the dropped commit.").
+		BoolVar(&cli.dropAbandon)
+
+	// Uplift
+	c = cli.Command("uplift", "Move a commit of the stack onto another branch, or a new branch from upstream.").
+		PreAction(recordOperation).
+		Action(cli.doUplift)
+	c.Arg("target", "Target commit sha, ref, label number or a part of its title.").
+		Required().
+		HintAction(labelHints).
+		StringVar(&cli.upliftTargetRef)
+	c.Flag("to", "Branch to move the commit to, created from upstream if it does not exist.").
+		Required().
+		StringVar(&cli.upliftTo)
+
+	// Reword
+	c = cli.Command("reword", "Replace the message of a commit of the stack, keeping its metadata and trailers, or edit all messages at once with --all.").
+		PreAction(recordOperation).
+		Action(cli.doReword)
+	c.Arg("target", "Target commit sha, ref, label number or a part of its title.").
+		HintAction(labelHints).
+		StringVar(&cli.rewordTargetRef)
+	c.Flag("message", "New message, the editor is opened when not given.").Short('m').
+		StringVar(&cli.rewordMessage)
+	c.Flag("edit", "Open the editor, starting from the -m message if given.").Short('e').
+		BoolVar(&cli.rewordEdit)
+	c.Flag("keep-meta", "Keep the metadata of the old title when the new one has none.").
+		Default("true").
+		BoolVar(&cli.rewordKeepMeta)
+	c.Flag("all", "Edit the messages of all commits of the stack in a single editor buffer.").
+		BoolVar(&cli.rewordAll)
+	c.Flag("strict", "With --all, restore the trailers removed while editing.").
+		BoolVar(&cli.rewordStrict)
+
+	// Exec
+	c = cli.Command("exec", "Run a command on every commit of the stack in a temporary worktree.").
+		Alias("test").
+		Action(cli.doExec)
+	c.Flag("keep-going", "Keep running on the remaining commits after a failure.").Short('k').
+		BoolVar(&cli.execKeepGoing)
+	c.Flag("json", "Print the report as JSON.").
+		BoolVar(&cli.execJSONFlag)
+	c.Flag("no-cache", "Run the command even on commits whose tree already passed it.").
+		BoolVar(&cli.execNoCache)
+	c.Arg("command", "Command to run through `sh -c`, example `exec -- make build`").
+		Required().
+		StringsVar(&cli.execCommandArgs)
+
 	// Label
-	c = cli.Command("label", "Label the revisions on a stack.").
+	c = cli.Command("label", "Label the revisions on a stack as D/NN, with the prefix from git-ext.labelPrefix. The labels are shared by all stacks unless git-ext.labelPerBranch is set, which names them D/<branch>/NN instead.").
 		Alias("l").
+		PreAction(recordOperation).
 		Action(cli.doLabel)
-	c.Flag("delete", "Delete the labels from the commits.").Short('d').
+	c.Flag("delete", "Delete the labels of the stack, which are those of every stack unless git-ext.labelPerBranch is set.").Short('d').
 		BoolVar(&cli.labelDeleteBranches)
+	c.Flag("stable", "Keep labels on the same logical change, tracked with a Change-Id trailer (config: git-ext.stableLabels).").Short('s').
+		BoolVar(&cli.labelStable)
+	c.Flag("hidden", "Write the labels as refs/stack/... refs instead of branches (config: git-ext.hiddenLabels).").
+		BoolVar(&cli.labelHidden)
+	c.Flag("migrate", "Move all branch labels to hidden refs and turn on git-ext.hiddenLabels.").
+		BoolVar(&cli.labelMigrate)
+
+	// History / Range Diff
+	c = cli.Command("history", "List the recorded versions of the stack.").
+		Action(cli.doHistory)
+	c = cli.Command("range-diff", "Compare two recorded versions of the stack, by default the last one that differs from HEAD and HEAD.").
+		Alias("rd").
+		Action(cli.doRangeDiff)
+	c.Arg("old", "Version to compare from, see `stack history`.").
+		StringVar(&cli.rangeDiffOld)
+	c.Arg("new", "Version to compare to, defaults to HEAD.").
+		StringVar(&cli.rangeDiffNew)
+
+	// Export
+	c = cli.Command("export", "Write the stack out as a patch series with a generated cover letter.").
+		Action(cli.doExport)
+	c.Flag("out", "Directory to write the patches to, or the file to write with --mbox.").Short('o').
+		Required().
+		StringVar(&cli.exportOut)
+	c.Flag("mbox", "Write the whole series into a single mbox file.").
+		BoolVar(&cli.exportMbox)
+	c.Flag("series", "Also write a quilt series file listing the patches.").
+		BoolVar(&cli.exportSeries)
+
+	// Import
+	c = cli.Command("import", "Apply a patch series onto upstream as a new stack branch and label it.").
+		PreAction(recordOperation).
+		Action(cli.doImport)
+	c.Arg("source", "An mbox file, or a directory of patches (in the order of its quilt series file if present).").
+		Required().
+		StringVar(&cli.importSource)
+	c.Flag("branch", "Name of the new branch, defaults to import/<source name>.").Short('b').
+		StringVar(&cli.importBranch)
+	c.Flag("detach-revisions", "Turn the Differential Revision trailers into Imported-From, so that sending the commits creates new revisions.").
+		BoolVar(&cli.importDetachRevisions)
+
+	// Continue / Abort / Status
+	c = cli.Command("continue", "Continue the git-ext command whose rebase stopped, then relabel the stack.").
+		Alias("c").
+		PreAction(recordOperation).
+		Action(cli.doContinue)
+	c = cli.Command("abort", "Abort the git-ext command whose rebase stopped and go back to where it started.").
+		PreAction(recordOperation).
+		Action(cli.doAbort)
+	c = cli.Command("status", "Show the git-ext command in progress.").
+		Action(cli.doStatus)
 
 	// NoQA:
 	_ = c
 }
 
 func (cli *stackCLI) doRebaseFileRewrite(ctx *kingpin.ParseContext) error {
-	file := cli.rebaseEditFile
-	prefix := cli.rebaseEditPrefix
+	todo, err := rebasetodo.ReadFile(cli.rebaseEditFile)
+	clitools.UserError(err)
 
-	RGX := regexp.MustCompile(`^(\w+)\s+([A-Fa-f0-9]+)\s+(.*)$`)
+	targetIdx := todo.Find(cli.rebaseEditPrefix)
+	if targetIdx >= 0 {
+		todo.Entries[targetIdx].Action = cli.rebaseEditAction
+		todo.Entries[targetIdx].Option = ""
 
-	fileRaw, err := ioutil.ReadFile(file)
-	clitools.UserError(err)
+		if cli.rebaseEditAmendFromFile != "" {
+			todo.Insert(targetIdx+1, rebasetodo.NewExec(fmt.Sprintf(
+				"git commit --amend --no-verify --allow-empty --quiet --file=%s", shellQuote(cli.rebaseEditAmendFromFile),
+			)))
+		}
+	}
 
-	out, err := os.OpenFile(file, os.O_RDWR, 0666)
-	clitools.UserError(err)
+	anchor, after := cli.rebaseEditMoveBefore, false
+	if cli.rebaseEditMoveAfter != "" {
+		anchor, after = cli.rebaseEditMoveAfter, true
+	}
+	if anchorIdx := todo.Find(anchor); targetIdx >= 0 && anchorIdx >= 0 {
+		todo.Move(targetIdx, anchorIdx, after)
+	}
 
 	fmt.Println("[REBASE_TODO]")
-	for _, line := range strings.Split(string(fileRaw), "\n") {
-		groups := RGX.FindStringSubmatch(line)
-		if len(groups) > 0 {
-			gCMD := groups[1]
-			gSHA := groups[2]
-			gComment := groups[3]
-
-			if strings.HasPrefix(gSHA, prefix) {
-				gCMD = "edit"
-			}
-
-			outLine := fmt.Sprintf("%s %s %s", gCMD, gSHA, gComment)
-			fmt.Println("| ", outLine)
-			fmt.Fprintln(out, outLine)
-		} else {
-			fmt.Fprintln(out, line)
-		}
+	for _, entry := range todo.Commands() {
+		fmt.Println("| ", entry)
 	}
 	fmt.Printf("[/REBASE_TODO]\n\n")
 
+	clitools.UserError(todo.WriteFile(cli.rebaseEditFile))
 	return nil
 }
 
+// moveItem moves the item at index from to just before, or just after, the item at index anchor.
+func moveItem(lines []string, from int, anchor int, after bool) []string {
+	line := lines[from]
+
+	var result []string
+	for idx, l := range lines {
+		if idx == from {
+			continue
+		}
+		if idx == anchor && !after {
+			result = append(result, line)
+		}
+		result = append(result, l)
+		if idx == anchor && after {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
 func (cli *stackCLI) doRebase(ctx *kingpin.ParseContext) error {
 	upstreamName, err := upstreamWithFlag(cli.upstreamOverride)
 	clitools.UserError(err)
@@ -144,56 +395,100 @@ func (cli *stackCLI) doRebase(ctx *kingpin.ParseContext) error {
 }
 
 func (cli *stackCLI) doEdit(ctx *kingpin.ParseContext) error {
-	targetSha, err := git.GetSha(cli.editTargetRef)
+	targetSha, err := resolveCommit(cli.editTargetRef)
 	clitools.UserError(err)
 
-	upstreamName, err := upstreamWithFlag(cli.upstreamOverride)
+	st, err := loadStack(cli.upstreamOverride)
 	clitools.UserError(err)
+	state, err := newStackState("edit", st)
+	clitools.UserError(err)
+	clitools.UserError(state.save())
+
+	err = cli.startEditRebase(targetSha)
+	state.check("Edit", err)
+
+	fmt.Println("Once done, run `git-ext stack continue` to finish the rebase and relabel the stack.")
+	return nil
+}
+
+// startEditRebase launches a rebase session against the merge base that stops at the target commit.
+func (cli *stackCLI) startEditRebase(targetSha string) error {
+	return cli.startTodoRebase(targetSha, todoRewrite{Action: "edit"})
+}
+
+// todoRewrite describes how `rebase-edit` rewrites the todo line of the target commit.
+type todoRewrite struct {
+	Action string
+
+	// AmendFromFile replaces the message of the resulting commit with the file contents.
+	AmendFromFile string
+
+	// MoveBefore and MoveAfter move the target line next to the line of another commit.
+	MoveBefore string
+	MoveAfter  string
+}
+
+// startTodoRebase launches a rebase session against the merge base with the todo line of
+// the target commit rewritten by `rebase-edit`.
+func (cli *stackCLI) startTodoRebase(targetSha string, rewrite todoRewrite) error {
+	upstreamName, err := upstreamWithFlag(cli.upstreamOverride)
+	if err != nil {
+		return err
+	}
 
 	mergeBaseCommit, err := git.GetMergeBase(upstreamName, "HEAD")
-	clitools.UserError(err)
+	if err != nil {
+		return err
+	}
 
 	fmt.Println(mergeBaseCommit)
-	gitEditCMD := fmt.Sprintf("%s stack rebase-edit --branchLabelPrefix=%s ", os.Args[0], targetSha[:7])
+	gitEditCMD := fmt.Sprintf("%s stack rebase-edit --branchLabelPrefix=%s --action=%s ", os.Args[0], targetSha[:7], rewrite.Action)
+	if rewrite.AmendFromFile != "" {
+		gitEditCMD += fmt.Sprintf("--amend-from-file=%s ", shellQuote(rewrite.AmendFromFile))
+	}
+	if rewrite.MoveBefore != "" {
+		gitEditCMD += fmt.Sprintf("--move-before=%s ", rewrite.MoveBefore[:7])
+	}
+	if rewrite.MoveAfter != "" {
+		gitEditCMD += fmt.Sprintf("--move-after=%s ", rewrite.MoveAfter[:7])
+	}
 
 	fmt.Println(gitEditCMD)
-	clitools.UserError(
-		git.
-			Cmd("rebase", "-i", mergeBaseCommit).
-			SetENV("GIT_SEQUENCE_EDITOR", gitEditCMD).
-			SetENV("LANG", "en_US.UTF-8").
-			SetENV("PATH", os.Getenv("PATH")).
-			PipeStdout(os.Stdout).PipeStderr(os.Stderr).
-			Run().Err(),
-	)
-
-	return nil
+	return git.
+		RebaseCmd(gitEditCMD, "-i", mergeBaseCommit).
+		PipeStdout(os.Stdout).PipeStderr(os.Stderr).
+		Run().Err()
 }
 
 func (cli *stackCLI) doLabel(ctx *kingpin.ParseContext) error {
-	if cli.labelDeleteBranches {
+	if cli.labelMigrate {
+		return cli.doLabelMigrate(ctx)
+	} else if cli.labelDeleteBranches {
 		return cli.doLabelDelete(ctx)
+	} else if cli.labelStable || git.GetConfigBool("git-ext.stableLabels", false) {
+		return cli.doLabelStable(ctx)
 	} else {
 		return cli.doLabelCreate(ctx)
 	}
 }
 
 func (cli *stackCLI) doLabelDelete(ctx *kingpin.ParseContext) error {
-	branches, err := git.ListBranches()
+	scheme, err := currentLabelScheme()
 	clitools.UserError(err)
-	for _, branchName := range branches {
-		if branchPattern.MatchString(branchName) {
-			clitools.UserError(
-				git.RawUnSetBranch(branchName, true).Run().
-					PipeStdout(os.Stdout).
-					Run().Err(),
-			)
-		}
+
+	labels, err := scheme.list()
+	clitools.UserError(err)
+	for name := range labels {
+		clitools.UserError(scheme.delete(name))
 	}
 	return nil
 }
 
 func (cli *stackCLI) doLabelCreate(ctx *kingpin.ParseContext) error {
+	scheme, err := currentLabelScheme()
+	clitools.UserError(err)
+	scheme.Hidden = scheme.Hidden || cli.labelHidden
+
 	upstreamName, err := upstreamWithFlag(cli.upstreamOverride)
 	clitools.UserError(err)
 
@@ -204,21 +499,17 @@ func (cli *stackCLI) doLabelCreate(ctx *kingpin.ParseContext) error {
 	clitools.UserError(err)
 
 	for idx := range pendingCommitList {
-		branchName := fmt.Sprintf(branchFormat, idx)
+		branchName := scheme.name(idx)
 		sha := pendingCommitList[len(pendingCommitList)-1-idx]
 
-		fmt.Printf("%02d| Creating branch: %v -> %v\n", idx, branchName, sha)
-		clitools.UserError(
-			git.RawSetBranch(sha, branchName, true).
-				PipeStdout(os.Stdout).
-				Run().Err(),
-		)
+		fmt.Printf("%02d| Creating label: %v -> %v\n", idx, branchName, sha)
+		clitools.UserError(scheme.set(branchName, sha))
 	}
 
 	return nil
 }
 
-func upstreamWithFlag(upstreamOverride string) (string, error)  {
+func upstreamWithFlag(upstreamOverride string) (string, error) {
 	var err error
 	var upstreamName string
 	if upstreamOverride != "" {
@@ -226,6 +517,196 @@ func upstreamWithFlag(upstreamOverride string) (string, error)  {
 	} else {
 		upstreamName, err = git.GetUpstream()
 	}
-	return  upstreamName, err
 
+	// With a detached HEAD, such as in the middle of a rebase, use the upstream of the stack branch.
+	if err != nil {
+		if current, _ := git.GetCurrentBranch(); current == "" {
+			if branch, branchErr := stackBranch(); branchErr == nil {
+				if upstreamName, upstreamErr := git.GetUpstreamOf(branch); upstreamErr == nil {
+					return upstreamName, nil
+				}
+			}
+		}
+	}
+	return upstreamName, err
+}
+
+// stack is the series of commits between the merge base with upstream and the head.
+type stack struct {
+	Head     string
+	Upstream string
+	Base     string
+
+	// Commits are ordered from the bottom of the stack to the top.
+	Commits []string
+}
+
+func loadStack(upstreamOverride string) (*stack, error) {
+	upstreamName, err := upstreamWithFlag(upstreamOverride)
+	if err != nil {
+		return nil, err
+	}
+	return loadStackAt(upstreamName, "HEAD")
+}
+
+// loadBranchStack loads the stack ending at the tip of the branch, using the upstream of the
+// branch unless overridden.
+func loadBranchStack(upstreamOverride string, branch string) (*stack, error) {
+	var err error
+	upstreamName := upstreamOverride
+	if upstreamName == "" {
+		upstreamName, err = git.GetUpstreamOf(branch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return loadStackAt(upstreamName, branch)
+}
+
+func loadStackAt(upstreamName string, head string) (*stack, error) {
+	mergeBaseCommit, err := git.GetMergeBase(upstreamName, head)
+	if err != nil {
+		return nil, err
+	}
+
+	pendingCommitList, err := git.ListObjectsInRange(mergeBaseCommit, head)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := make([]string, len(pendingCommitList))
+	for idx, sha := range pendingCommitList {
+		commits[len(pendingCommitList)-1-idx] = sha
+	}
+
+	return &stack{
+		Head:     head,
+		Upstream: upstreamName,
+		Base:     mergeBaseCommit,
+		Commits:  commits,
+	}, nil
+}
+
+// indexOf returns the position of the commit in the stack, or -1 if it is not on the stack.
+func (st *stack) indexOf(sha string) int {
+	for idx, commit := range st.Commits {
+		if commit == sha {
+			return idx
+		}
+	}
+	return -1
+}
+
+// findCommit resolves a commit of the stack from a SHA, ref or label, or else from a case
+// insensitive search of the commit titles that has to match a single commit.
+func (st *stack) findCommit(ref string) (string, error) {
+	if sha, err := resolveCommit(ref); err == nil {
+		if st.indexOf(sha) < 0 {
+			return "", fmt.Errorf("%v is not on the stack", sha[:7])
+		}
+		return sha, nil
+	}
+
+	var matches, descriptions []string
+	for _, sha := range st.Commits {
+		title, err := git.GetCommitWithFormat(sha, "%s")
+		if err != nil {
+			return "", err
+		}
+		if strings.Contains(strings.ToLower(title), strings.ToLower(ref)) {
+			matches = append(matches, sha)
+			descriptions = append(descriptions, fmt.Sprintf("%v %v", sha[:7], title))
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no commit on the stack is named or titled %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%q matches several commits:\n  %v", ref, strings.Join(descriptions, "\n  "))
+	}
+}
+
+// tip returns the SHA of the top commit of the stack, or of the merge base if it is empty.
+func (st *stack) tip() string {
+	if len(st.Commits) == 0 {
+		return st.Base
+	}
+	return st.Commits[len(st.Commits)-1]
+}
+
+// replayStack replays the commits, which are the stack commits possibly reordered, filtered or
+// edited, on top of the merge base in the object database and moves HEAD to the result. It
+// returns the SHAs of the recreated commits keyed by the original ones, and a
+// git.ConflictError if the commits do not replay cleanly, in which case nothing is changed.
+func replayStack(st *stack, commits []string, edit func(commit *git.Commit) error, reason string) (map[string]string, error) {
+	rewritten, tip, err := git.Replay(st.Base, commits, edit)
+	if err != nil {
+		return nil, err
+	}
+	if tip == st.tip() {
+		return rewritten, nil
+	}
+
+	if err := snapshotStack("before " + reason); err != nil {
+		return nil, err
+	}
+	if err := git.UpdateHead(tip, st.tip(), "git-ext: "+reason); err != nil {
+		return nil, err
+	}
+	return rewritten, snapshotStack(reason)
+}
+
+// stackBranch returns the branch holding the stack, which is either the checked out branch, the
+// branch being rebased or, with a detached HEAD, the only branch that contains HEAD.
+func stackBranch() (string, error) {
+	branch, err := git.GetCurrentBranch()
+	if err == nil && branch != "" {
+		return branch, nil
+	}
+
+	if git.IsRebaseInProgress() {
+		branch, err = git.GetRebaseHeadName()
+		if err == nil && branch != "" {
+			return branch, nil
+		}
+	}
+
+	branches, err := git.ListBranchesContaining("HEAD")
+	if err != nil {
+		return "", err
+	}
+
+	var candidates []string
+	for _, name := range branches {
+		if !isLabelBranch(name) {
+			candidates = append(candidates, name)
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("HEAD is detached and not contained in any branch")
+	case 1:
+		return candidates[0], nil
+	default:
+		return "", fmt.Errorf("HEAD is detached and contained in several branches: %v", strings.Join(candidates, ", "))
+	}
+}
+
+// extDataPath returns the path of a file owned by git-ext inside of the git directory,
+// creating the directory holding it as needed.
+func extDataPath(name string) (string, error) {
+	dataPath, err := git.GetGitPath(path.Join("git-ext", name))
+	if err != nil {
+		return "", err
+	}
+	return dataPath, os.MkdirAll(path.Dir(dataPath), 0777)
+}
+
+// shellQuote quotes the value for use in commands that git runs through the shell.
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
 }
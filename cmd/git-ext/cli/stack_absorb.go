@@ -0,0 +1,318 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var hunkHeaderPattern = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// diffHunk is a single zero context hunk of a diff.
+type diffHunk struct {
+	OldStart int
+	OldCount int
+	NewCount int
+	Lines    []string
+
+	// Target is the stack commit the hunk is absorbed into.
+	Target string
+}
+
+// diffFile is the part of a diff that changes a single file.
+type diffFile struct {
+	Path   string
+	Header []string
+	Hunks  []*diffHunk
+
+	// Absorbable is false for additions, deletions, mode changes and binary changes which can
+	// not be attributed to a stack commit.
+	Absorbable bool
+}
+
+func (cli *stackCLI) doAbsorb(ctx *kingpin.ParseContext) error {
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	if len(st.Commits) == 0 {
+		clitools.UserErrorStr("Absorb", "there are no commits on the stack")
+	}
+
+	var rawDiff bytes.Buffer
+	clitools.UserError(
+		git.Cmd("diff", "--cached", "-U0", "--no-color", "--no-ext-diff", "--no-renames", "--src-prefix=a/", "--dst-prefix=b/").
+			PipeStdout(&rawDiff).
+			Run().Err(),
+	)
+	files := parseDiff(rawDiff.String())
+	if len(files) == 0 {
+		clitools.UserErrorStr("Absorb", "there are no staged changes to absorb")
+	}
+
+	onStack := map[string]bool{}
+	for _, sha := range st.Commits {
+		onStack[sha] = true
+	}
+
+	var unattributed []string
+	absorbed := map[string][]string{}
+	for _, file := range files {
+		if !file.Absorbable {
+			unattributed = append(unattributed, fmt.Sprintf("%v (not a plain modification)", file.Path))
+			continue
+		}
+		clitools.UserError(attributeHunks(st, file))
+
+		for _, hunk := range file.Hunks {
+			location := fmt.Sprintf("%v:%d", file.Path, hunk.OldStart)
+			if onStack[hunk.Target] {
+				absorbed[hunk.Target] = append(absorbed[hunk.Target], location)
+			} else {
+				hunk.Target = ""
+				unattributed = append(unattributed, location)
+			}
+		}
+	}
+
+	var targets []string
+	for _, sha := range st.Commits {
+		if len(absorbed[sha]) > 0 {
+			targets = append(targets, sha)
+		}
+	}
+	if len(targets) == 0 {
+		reportUnattributed(unattributed)
+		clitools.UserErrorStr("Absorb", "none of the staged hunks could be attributed to a commit on the stack")
+	}
+
+	// Build one fixup commit per target on top of HEAD without touching the real index, so
+	// hunks that are not absorbed stay staged once HEAD moves.
+	headSha, err := git.GetSha("HEAD")
+	clitools.UserError(err)
+
+	indexFile, err := extDataPath("absorb.index")
+	clitools.UserError(err)
+	defer os.Remove(indexFile)
+
+	parent := headSha
+	included := map[string]bool{}
+	for _, target := range targets {
+		included[target] = true
+
+		var patch bytes.Buffer
+		for _, file := range files {
+			patch.WriteString(file.patch(func(hunk *diffHunk) bool {
+				return included[hunk.Target]
+			}))
+		}
+
+		clitools.UserError(git.CmdWithIndex(indexFile, "read-tree", headSha).Run().Err())
+		clitools.UserError(
+			git.CmdWithIndex(indexFile, "apply", "--cached", "--unidiff-zero", "-").
+				PipeStdin(&patch).
+				Run().Err(),
+		)
+		tree, err := git.CmdWithIndex(indexFile, "write-tree").Run().Value()
+		clitools.UserError(err)
+
+		// The target is named by its SHA, as its subject may be shared with other commits.
+		parent, err = git.Cmd("commit-tree", tree, "-p", parent, "-F", "-").
+			PipeStdin(strings.NewReader("fixup! " + target + "\n")).
+			Run().Value()
+		clitools.UserError(err)
+	}
+
+	clitools.UserError(git.Cmd("update-ref", "-m", "git-ext: absorb", "HEAD", parent, headSha).Run().Err())
+
+	for _, target := range targets {
+		title, err := git.GetCommitWithFormat(target, "%s")
+		clitools.UserError(err)
+
+		fmt.Printf("%v %v\n", target[:7], title)
+		for _, location := range absorbed[target] {
+			fmt.Printf("  <- %v\n", location)
+		}
+	}
+	reportUnattributed(unattributed)
+
+	// Whatever was not absorbed is kept aside while the fixups are squashed, and restored
+	// with the index intact afterwards.
+	state, err := newStackState("absorb", st)
+	clitools.UserError(err)
+	state.autosquash("Absorb")
+
+	_, _, err = state.finish()
+	clitools.UserError(err)
+	return nil
+}
+
+func reportUnattributed(locations []string) {
+	if len(locations) == 0 {
+		return
+	}
+	fmt.Println("\nLeft staged, could not be attributed to a single stack commit:")
+	for _, location := range locations {
+		fmt.Printf("  %v\n", location)
+	}
+}
+
+// attributeHunks sets the target of every hunk whose original lines were all last changed by
+// the same commit of the stack. Pure additions are attributed by the lines surrounding them.
+func attributeHunks(st *stack, file *diffFile) error {
+	var contents bytes.Buffer
+	err := git.RawGetObjectContents("HEAD:" + file.Path).PipeStdout(&contents).Run().Err()
+	if err != nil {
+		return err
+	}
+	lineCount := strings.Count(contents.String(), "\n")
+	if contents.Len() > 0 && !strings.HasSuffix(contents.String(), "\n") {
+		lineCount++
+	}
+
+	hunkLines := make([][]int, len(file.Hunks))
+	var allLines []int
+	for idx, hunk := range file.Hunks {
+		var lines []int
+		if hunk.OldCount > 0 {
+			for line := hunk.OldStart; line < hunk.OldStart+hunk.OldCount; line++ {
+				lines = append(lines, line)
+			}
+		} else {
+			for _, line := range []int{hunk.OldStart, hunk.OldStart + 1} {
+				if line >= 1 && line <= lineCount {
+					lines = append(lines, line)
+				}
+			}
+		}
+		hunkLines[idx] = lines
+		allLines = append(allLines, lines...)
+	}
+	if len(allLines) == 0 {
+		return nil
+	}
+
+	owners, err := git.BlameLines(st.Base, "HEAD", file.Path, allLines)
+	if err != nil {
+		return err
+	}
+
+	for idx, hunk := range file.Hunks {
+		commits := map[string]bool{}
+		for _, line := range hunkLines[idx] {
+			commits[owners[line]] = true
+		}
+		if len(commits) == 1 {
+			for sha := range commits {
+				hunk.Target = sha
+			}
+		}
+	}
+	return nil
+}
+
+// parseDiff splits a zero context diff into files and hunks.
+func parseDiff(diff string) []*diffFile {
+	var files []*diffFile
+	var file *diffFile
+	var hunk *diffHunk
+
+	lines := strings.Split(diff, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			file = &diffFile{Header: []string{line}}
+			hunk = nil
+			files = append(files, file)
+		case file == nil:
+			continue
+		case hunk == nil && !strings.HasPrefix(line, "@@"):
+			file.Header = append(file.Header, line)
+			if strings.HasPrefix(line, "+++ b/") {
+				file.Path = strings.TrimPrefix(line, "+++ b/")
+			}
+		case strings.HasPrefix(line, "@@"):
+			groups := hunkHeaderPattern.FindStringSubmatch(line)
+			if groups == nil {
+				continue
+			}
+			hunk = &diffHunk{
+				OldStart: atoiOr(groups[1], 0),
+				OldCount: atoiOr(groups[2], 1),
+				NewCount: atoiOr(groups[4], 1),
+			}
+			file.Hunks = append(file.Hunks, hunk)
+		default:
+			hunk.Lines = append(hunk.Lines, line)
+		}
+	}
+
+	for _, file := range files {
+		file.Absorbable = file.Path != "" && len(file.Hunks) > 0
+		for _, line := range file.Header {
+			if strings.HasPrefix(line, "--- /dev/null") || strings.HasPrefix(line, "old mode") {
+				file.Absorbable = false
+			}
+		}
+	}
+	return files
+}
+
+// patch renders the selected hunks of the file as a patch, fixing up the new line numbers
+// of every hunk to account for the hunks left out.
+func (file *diffFile) patch(keep func(hunk *diffHunk) bool) string {
+	var hunks []*diffHunk
+	for _, hunk := range file.Hunks {
+		if keep(hunk) {
+			hunks = append(hunks, hunk)
+		}
+	}
+	if len(hunks) == 0 {
+		return ""
+	}
+	sort.SliceStable(hunks, func(i, j int) bool { return hunks[i].OldStart < hunks[j].OldStart })
+
+	var out strings.Builder
+	for _, line := range file.Header {
+		out.WriteString(line + "\n")
+	}
+
+	delta := 0
+	for _, hunk := range hunks {
+		newStart := hunk.OldStart + delta
+		if hunk.OldCount == 0 {
+			newStart++
+		} else if hunk.NewCount == 0 {
+			newStart--
+		}
+		delta += hunk.NewCount - hunk.OldCount
+
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", hunk.OldStart, hunk.OldCount, newStart, hunk.NewCount)
+		for _, line := range hunk.Lines {
+			out.WriteString(line + "\n")
+		}
+	}
+	return out.String()
+}
+
+func atoiOr(value string, fallback int) int {
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback
+	}
+	return n
+}
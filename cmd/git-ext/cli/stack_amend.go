@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// doAmend folds the staged changes into a commit of the stack. The descendants are replayed
+// in the object database, and only if they conflict is the change squashed in with a rebase,
+// which can then be finished with `stack continue`.
+func (cli *stackCLI) doAmend(ctx *kingpin.ParseContext) error {
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	targetSha, err := st.findCommit(cli.amendTargetRef)
+	clitools.UserError(err)
+
+	stagedTree, err := git.WriteIndexTree()
+	clitools.UserError(err)
+	headTree, err := git.GetSha("HEAD^{tree}")
+	clitools.UserError(err)
+	if stagedTree == headTree {
+		clitools.UserErrorStr("Amend", "there are no staged changes to amend %v with", targetSha[:7])
+	}
+
+	// The staged changes as a commit on top of HEAD, to be picked onto the target.
+	staged := &git.Commit{SHA: st.tip(), Tree: stagedTree, Parents: []string{st.tip()}}
+
+	rewritten, err := replayStack(st, st.Commits, func(commit *git.Commit) error {
+		if commit.SHA != targetSha {
+			return nil
+		}
+		var err error
+		commit.Tree, err = git.PickTree(staged, targetSha)
+		return err
+	}, "stack amend "+targetSha[:7])
+	if _, ok := err.(*git.ConflictError); ok {
+		fmt.Printf("The change does not replay cleanly, squashing it into %v with a rebase\n", targetSha[:7])
+		cli.amendInWorktree(st, targetSha)
+		return nil
+	}
+	clitools.UserError(err)
+
+	scheme, err := currentLabelScheme()
+	clitools.UserError(err)
+	clitools.UserError(scheme.move(rewritten, nil))
+
+	if newSha, ok := rewritten[targetSha]; ok {
+		fmt.Printf("Amended %v -> %v\n", targetSha[:7], newSha[:7])
+	} else {
+		fmt.Printf("The staged changes leave %v as is\n", targetSha[:7])
+	}
+	return nil
+}
+
+// amendInWorktree commits the staged changes as a fixup of the target and squashes it in with
+// an autosquash rebase.
+func (cli *stackCLI) amendInWorktree(st *stack, targetSha string) {
+	clitools.UserError(
+		git.Cmd("commit", "--quiet", "--no-verify", "--fixup="+targetSha).Run().Err(),
+	)
+
+	state, err := newStackState("amend", st)
+	clitools.UserError(err)
+	state.autosquash("Amend")
+
+	rewritten, _, err := state.finish()
+	clitools.UserError(err)
+
+	if newSha, ok := rewritten[targetSha]; ok {
+		fmt.Printf("Amended %v -> %v\n", targetSha[:7], newSha[:7])
+	} else {
+		fmt.Printf("The staged changes leave %v as is\n", targetSha[:7])
+	}
+}
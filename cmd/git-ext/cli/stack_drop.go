@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/rebasetodo"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/arc"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// revisionIDPattern matches the ID of a Phabricator revision in its URL.
+var revisionIDPattern = regexp.MustCompile(`D\d+`)
+
+// doDrop removes a commit from the stack with a rebase that marks its todo line as dropped.
+// The commit is printed beforehand so it can be recovered even if the rebase stops.
+func (cli *stackCLI) doDrop(ctx *kingpin.ParseContext) error {
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	targetSha, err := st.findCommit(cli.dropTargetRef)
+	clitools.UserError(err)
+
+	message, err := git.GetCommitWithFormat(targetSha, "%B")
+	clitools.UserError(err)
+	title, _, _ := metadataFromString(message)
+	revision := arc.FindRevision(message)
+
+	fmt.Printf("Dropping %v %v\n", targetSha[:7], title)
+	fmt.Printf("Recover it with `git cherry-pick %v`\n\n", targetSha)
+
+	state, err := newStackState("drop", st)
+	clitools.UserError(err)
+	state.Removed = []string{targetSha}
+	if cli.dropAbandon {
+		if revision == "" {
+			fmt.Printf("%v has no revision to abandon\n", targetSha[:7])
+		} else {
+			state.Abandon = []string{revision}
+		}
+	}
+	clitools.UserError(state.save())
+
+	err = cli.startTodoRebase(targetSha, todoRewrite{Action: rebasetodo.Drop})
+	state.check("Drop", err)
+
+	_, _, err = state.finish()
+	clitools.UserError(err)
+
+	fmt.Printf("Dropped %v\n", targetSha[:7])
+	return nil
+}
+
+// abandonRevision abandons the Phabricator revision with the given URL or ID.
+func abandonRevision(revision string) error {
+	revisionID := revisionIDPattern.FindString(revision)
+	if revisionID == "" {
+		return fmt.Errorf("no revision ID in %q", revision)
+	}
+
+	request, err := json.Marshal(jsM{
+		"objectIdentifier": revisionID,
+		"transactions": jsA{
+			jsM{
+				"type":  "abandon",
+				"value": true,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = arc.ConduitCall("differential.revision.edit", request)
+	return err
+}
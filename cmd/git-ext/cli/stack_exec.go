@@ -0,0 +1,231 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	shutils "github.com/NonLogicalDev/nld.lib.go.shutils"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	execStatusPass = "pass"
+	execStatusFail = "fail"
+	execStatusSkip = "skip"
+)
+
+type stackExecResult struct {
+	Index    int     `json:"index"`
+	SHA      string  `json:"sha"`
+	Tree     string  `json:"tree"`
+	Title    string  `json:"title"`
+	Status   string  `json:"status"`
+	Cached   bool    `json:"cached"`
+	ExitCode int     `json:"exit_code"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// testCache records the outcome of commands run on a tree, so that commits which were only
+// reworded or rebased without changes are not tested again. It is shared by all worktrees.
+type testCache struct {
+	path string
+
+	Results map[string]testCacheEntry `json:"results"`
+}
+
+type testCacheEntry struct {
+	Tree    string    `json:"tree"`
+	Command string    `json:"command"`
+	Status  string    `json:"status"`
+	Time    time.Time `json:"time"`
+}
+
+func loadTestCache() (*testCache, error) {
+	commonDir, err := git.GetCommonDir()
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &testCache{
+		path:    path.Join(commonDir, "git-ext", "test-results.json"),
+		Results: map[string]testCacheEntry{},
+	}
+
+	raw, err := ioutil.ReadFile(cache.path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return cache, json.Unmarshal(raw, cache)
+}
+
+func (cache *testCache) save() error {
+	raw, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(cache.path), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cache.path, raw, 0666)
+}
+
+func (cache *testCache) passed(tree string, command string) bool {
+	return cache.Results[tree+":"+command].Status == execStatusPass
+}
+
+// passedAny reports whether any command passed on the tree.
+func (cache *testCache) passedAny(tree string) bool {
+	for _, entry := range cache.Results {
+		if entry.Tree == tree && entry.Status == execStatusPass {
+			return true
+		}
+	}
+	return false
+}
+
+func (cache *testCache) record(tree string, command string, status string) {
+	cache.Results[tree+":"+command] = testCacheEntry{
+		Tree:    tree,
+		Command: command,
+		Status:  status,
+		Time:    time.Now(),
+	}
+}
+
+func (cli *stackCLI) doExec(ctx *kingpin.ParseContext) error {
+	command := strings.Join(cli.execCommandArgs, " ")
+
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	if len(st.Commits) == 0 {
+		clitools.UserErrorStr("Exec", "there are no commits on the stack")
+	}
+
+	// Command output goes to stderr when stdout is reserved for the JSON report.
+	var output io.Writer = os.Stdout
+	if cli.execJSONFlag {
+		output = os.Stderr
+	}
+
+	cache, err := loadTestCache()
+	clitools.UserError(err)
+
+	results, err := execOnCommits(st.Commits, command, output, cli.execKeepGoing, cache, !cli.execNoCache)
+	clitools.UserError(err)
+	clitools.UserError(cache.save())
+
+	if cli.execJSONFlag {
+		out, err := json.MarshalIndent(results, "", "  ")
+		clitools.UserError(err)
+		fmt.Println(string(out))
+	} else {
+		printExecResults(results)
+	}
+
+	failed := 0
+	for _, result := range results {
+		if result.Status == execStatusFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		clitools.UserErrorStr("Exec", "`%v` failed on %d of %d commits", command, failed, len(st.Commits))
+	}
+	return nil
+}
+
+// execOnCommits runs the command on each of the commits in turn, checked out in a temporary
+// worktree so that the working copy is left alone. Unless keepGoing is set the commits after
+// the first failure are skipped. Every outcome is recorded in the cache, and with reuse set
+// commits whose tree already passed are not run again.
+func execOnCommits(commits []string, command string, output io.Writer, keepGoing bool, cache *testCache, reuse bool) ([]stackExecResult, error) {
+	worktree, err := ioutil.TempDir("", "git-ext-exec-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(worktree)
+
+	if err := git.Cmd("worktree", "add", "--detach", worktree, commits[0]).Run().Err(); err != nil {
+		return nil, err
+	}
+	defer git.Cmd("worktree", "remove", "--force", worktree).Run()
+
+	results := make([]stackExecResult, 0, len(commits))
+	failed := false
+	for idx, sha := range commits {
+		title, err := git.GetCommitWithFormat(sha, "%s")
+		if err != nil {
+			return nil, err
+		}
+
+		tree, err := git.GetSha(sha + "^{tree}")
+		if err != nil {
+			return nil, err
+		}
+
+		result := stackExecResult{Index: idx + 1, SHA: sha, Tree: tree, Title: title, Status: execStatusSkip}
+		if failed && !keepGoing {
+			results = append(results, result)
+			continue
+		}
+		if reuse && cache.passed(tree, command) {
+			result.Status = execStatusPass
+			result.Cached = true
+			results = append(results, result)
+			continue
+		}
+
+		err = git.Cmd("-C", worktree, "checkout", "--quiet", "--force", "--detach", sha).Run().Err()
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(output, "%02d| %v %v\n", idx+1, sha[:7], title)
+		started := time.Now()
+		run := shutils.Cmd("sh", "-c", command).PipeStdout(output).PipeStderr(os.Stderr)
+		run.X.Dir = worktree
+		run.Run()
+
+		result.Seconds = time.Since(started).Seconds()
+		result.Status = execStatusPass
+		if run.State() == nil || !run.State().Success() {
+			result.Status = execStatusFail
+			result.ExitCode = -1
+			if run.State() != nil {
+				result.ExitCode = run.State().ExitCode()
+			}
+			failed = true
+		}
+		cache.record(tree, command, result.Status)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func printExecResults(results []stackExecResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "\n#\tSHA\tSTATUS\tTIME\tTITLE")
+	for idx := len(results) - 1; idx >= 0; idx-- {
+		r := results[idx]
+		elapsed := "-"
+		if r.Cached {
+			elapsed = "cached"
+		} else if r.Status != execStatusSkip {
+			elapsed = fmt.Sprintf("%.1fs", r.Seconds)
+		}
+		fmt.Fprintf(w, "%02d\t%s\t%s\t%s\t%s\n", r.Index, r.SHA[:7], strings.ToUpper(r.Status), elapsed, r.Title)
+	}
+	w.Flush()
+}
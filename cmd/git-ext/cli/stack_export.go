@@ -0,0 +1,113 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/arc"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Placeholders of the cover letter written by `git format-patch --cover-letter`.
+const (
+	coverSubjectPlaceholder = "*** SUBJECT HERE ***"
+	coverBlurbPlaceholder   = "*** BLURB HERE ***"
+)
+
+// doExport writes the stack out as a patch series with a cover letter built from the commit
+// titles and metadata. The series is either a directory of patches, optionally with a quilt
+// series file, or a single mbox.
+func (cli *stackCLI) doExport(ctx *kingpin.ParseContext) error {
+	if cli.exportMbox && cli.exportSeries {
+		clitools.UserErrorStr("Export", "--mbox and --series can not be combined")
+	}
+
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+	if len(st.Commits) == 0 {
+		clitools.UserErrorStr("Export", "the stack is empty")
+	}
+
+	subject, blurb, err := coverLetter(st)
+	clitools.UserError(err)
+	fillCover := strings.NewReplacer(coverSubjectPlaceholder, subject, coverBlurbPlaceholder, blurb)
+
+	patchRange := st.Base + ".." + st.tip()
+
+	if cli.exportMbox {
+		var out bytes.Buffer
+		err := git.Cmd("format-patch", "--stdout", "--cover-letter", patchRange).
+			PipeStdout(&out).
+			Run().Err()
+		clitools.UserError(err)
+
+		// Only the cover letter comes with the placeholders, it is the first mail.
+		mbox := out.String()
+		if idx := strings.Index(mbox, "\nFrom "); idx >= 0 {
+			mbox = fillCover.Replace(mbox[:idx]) + mbox[idx:]
+		}
+		clitools.UserError(ioutil.WriteFile(cli.exportOut, []byte(mbox), 0666))
+
+		fmt.Printf("Wrote %d patches to %v\n", len(st.Commits), cli.exportOut)
+		return nil
+	}
+
+	out, err := git.Cmd("format-patch", "--cover-letter", "-o", cli.exportOut, patchRange).Run().Value()
+	clitools.UserError(err)
+	files := strings.Split(out, "\n")
+
+	coverFile := files[0]
+	cover, err := ioutil.ReadFile(coverFile)
+	clitools.UserError(err)
+	clitools.UserError(ioutil.WriteFile(coverFile, []byte(fillCover.Replace(string(cover))), 0666))
+
+	if cli.exportSeries {
+		var series strings.Builder
+		for _, file := range files[1:] {
+			fmt.Fprintln(&series, filepath.Base(file))
+		}
+		seriesFile := filepath.Join(cli.exportOut, "series")
+		clitools.UserError(ioutil.WriteFile(seriesFile, []byte(series.String()), 0666))
+		files = append(files, seriesFile)
+	}
+
+	for _, file := range files {
+		fmt.Println(file)
+	}
+	return nil
+}
+
+// coverLetter builds the subject and blurb of the cover letter. The subject is the name of the
+// stack branch with the metadata of all commits, the blurb lists the commits with their
+// metadata and revisions.
+func coverLetter(st *stack) (string, string, error) {
+	var metas []string
+	var blurb strings.Builder
+
+	fmt.Fprintf(&blurb, "This series contains %d commits:\n\n", len(st.Commits))
+	for idx, sha := range st.Commits {
+		message, err := git.GetCommitWithFormat(sha, "%B")
+		if err != nil {
+			return "", "", err
+		}
+
+		title, meta, _ := metadataFromString(message)
+		metas = append(metas, meta)
+
+		fmt.Fprintf(&blurb, "  %d/%d %v\n", idx+1, len(st.Commits), metadataToString(title, meta, ""))
+		if revision := arc.FindRevision(message); revision != "" {
+			fmt.Fprintf(&blurb, "      %v\n", revision)
+		}
+	}
+
+	name, err := stackBranch()
+	if err != nil {
+		name = "Stack on " + st.Upstream
+	}
+	return metadataToString(name, mergeMetadata(metas...), ""), strings.TrimRight(blurb.String(), "\n"), nil
+}
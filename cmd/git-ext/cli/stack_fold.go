@@ -0,0 +1,99 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func (cli *stackCLI) doFold(ctx *kingpin.ParseContext) error {
+	targetSha, err := resolveCommit(cli.foldTargetRef)
+	clitools.UserError(err)
+
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	idx := st.indexOf(targetSha)
+	if idx < 0 {
+		clitools.UserErrorStr("Fold", "%v is not on the stack", targetSha[:7])
+	}
+	if idx == 0 {
+		clitools.UserErrorStr("Fold", "%v is at the bottom of the stack, there is nothing to fold it into", targetSha[:7])
+	}
+	parentSha := st.Commits[idx-1]
+
+	parentMessage, err := git.GetCommitWithFormat(parentSha, "%B")
+	clitools.UserError(err)
+	targetMessage, err := git.GetCommitWithFormat(targetSha, "%B")
+	clitools.UserError(err)
+
+	messageFile, err := extDataPath("FOLD_MSG")
+	clitools.UserError(err)
+	clitools.UserError(ioutil.WriteFile(
+		messageFile, []byte(foldMessage(parentMessage, targetMessage, cli.foldMode == "squash")), 0666,
+	))
+
+	state, err := newStackState("fold", st)
+	clitools.UserError(err)
+	state.Removed = []string{targetSha}
+	state.TempFiles = []string{messageFile}
+	clitools.UserError(state.save())
+
+	err = cli.startTodoRebase(targetSha, todoRewrite{Action: cli.foldMode, AmendFromFile: messageFile})
+	state.check("Fold", err)
+
+	rewritten, _, err := state.finish()
+	clitools.UserError(err)
+
+	fmt.Printf("Folded %v into %v -> %v\n", targetSha[:7], parentSha[:7], rewritten[parentSha][:7])
+	return nil
+}
+
+// foldRevisionTrailer is the key of the revision trailer, which is not carried over by a fold.
+const foldRevisionTrailer = "Differential Revision"
+
+// foldMessage builds the message of a commit folded into its parent. The metadata of both
+// is combined, and in squash mode the target message is added to the parent text, before its
+// trailers. The trailers of the target are kept unless the parent has the same key, except for
+// its revision and Change-Id, which belong to the folded commit.
+func foldMessage(parentMessage string, targetMessage string, squash bool) string {
+	parentTitle, parentMeta, parentBody := metadataFromString(parentMessage)
+	targetTitle, targetMeta, _ := metadataFromString(targetMessage)
+	meta := mergeMetadata(parentMeta, targetMeta)
+	if !squash {
+		return metadataToString(parentTitle, meta, parentBody)
+	}
+
+	parentText, parentTrailers := splitTrailers(parentMessage)
+	targetText, targetTrailers := splitTrailers(targetMessage)
+	parentTitle, _, parentBody = metadataFromString(parentText)
+	_, _, targetBody := metadataFromString(targetText)
+
+	trailers := parentTrailers
+	present := map[string]bool{
+		trailerKey(foldRevisionTrailer): true,
+		trailerKey(changeIDTrailer):     true,
+	}
+	for _, trailer := range parentTrailers {
+		present[trailerKey(trailer)] = true
+	}
+	for _, trailer := range targetTrailers {
+		if !present[trailerKey(trailer)] {
+			trailers = append(trailers, trailer)
+		}
+	}
+
+	squashed := strings.TrimSpace(targetTitle + "\n\n" + strings.TrimSpace(targetBody))
+	body := "\n" + squashed
+	if strings.TrimSpace(parentBody) != "" {
+		body = strings.TrimRight(parentBody, "\n") + "\n\n" + squashed
+	}
+	if len(trailers) > 0 {
+		body += "\n\n" + strings.Join(trailers, "\n")
+	}
+	return metadataToString(parentTitle, meta, body+"\n")
+}
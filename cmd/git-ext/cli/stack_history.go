@@ -0,0 +1,201 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// historyRefPrefix is where the versions of every stack are kept, refs/git-ext/history/<branch>/<n>.
+const historyRefPrefix = "refs/git-ext/history/"
+
+// rangeDiffHeaderPattern matches the pair lines of `git range-diff`, e.g.
+// "1:  1a2b3c4 ! 1:  5d6e7f8 Title".
+var rangeDiffHeaderPattern = regexp.MustCompile(`^(\s*(?:\d+|-):\s+([0-9a-f]+|-+)\s+[=!<>]\s+(?:\d+|-):\s+([0-9a-f]+|-+))\s(.*)$`)
+
+// stackSnapshot is a recorded version of the stack.
+type stackSnapshot struct {
+	Number int
+	Ref    string
+	SHA    string
+}
+
+// listSnapshots returns the recorded versions of the stack on the branch, oldest first.
+func listSnapshots(branch string) ([]stackSnapshot, error) {
+	refs, err := git.ListRefs(historyRefPrefix + branch + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []stackSnapshot
+	for ref, sha := range refs {
+		number, err := strconv.Atoi(strings.TrimPrefix(ref, historyRefPrefix+branch+"/"))
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, stackSnapshot{Number: number, Ref: ref, SHA: sha})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Number < snapshots[j].Number
+	})
+	return snapshots, nil
+}
+
+// snapshotStack records HEAD as a new version of the stack on the current branch, unless it is
+// the version recorded last. Nothing is recorded when there is no stack branch.
+func snapshotStack(reason string) error {
+	branch, err := stackBranch()
+	if err != nil {
+		return nil
+	}
+	head, err := git.GetSha("HEAD")
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := listSnapshots(branch)
+	if err != nil {
+		return err
+	}
+
+	number := 1
+	if len(snapshots) > 0 {
+		last := snapshots[len(snapshots)-1]
+		if last.SHA == head {
+			return nil
+		}
+		number = last.Number + 1
+	}
+
+	ref := fmt.Sprintf("%v%v/%d", historyRefPrefix, branch, number)
+	return git.Cmd("update-ref", "--create-reflog", "-m", "git-ext: "+reason, ref, head).Run().Err()
+}
+
+func (cli *stackCLI) doHistory(ctx *kingpin.ParseContext) error {
+	branch, err := stackBranch()
+	clitools.UserError(err)
+
+	snapshots, err := listSnapshots(branch)
+	clitools.UserError(err)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tSHA\tRECORDED BY\tTITLE")
+	for idx := len(snapshots) - 1; idx >= 0; idx-- {
+		snapshot := snapshots[idx]
+
+		reason, _ := git.Cmd("log", "-g", "-1", "--format=%gs", snapshot.Ref).Run().Value()
+		title, err := git.GetCommitWithFormat(snapshot.SHA, "%s")
+		clitools.UserError(err)
+
+		fmt.Fprintf(w, "%d\t%v\t%v\t%v\n", snapshot.Number, snapshot.SHA[:7], strings.TrimPrefix(reason, "git-ext: "), title)
+	}
+	return w.Flush()
+}
+
+// doRangeDiff compares two versions of the stack, by default the last recorded one that
+// differs from HEAD and HEAD.
+// The commit pairs are annotated with the labels of the current stack.
+func (cli *stackCLI) doRangeDiff(ctx *kingpin.ParseContext) error {
+	branch, err := stackBranch()
+	clitools.UserError(err)
+
+	snapshots, err := listSnapshots(branch)
+	clitools.UserError(err)
+
+	resolve := func(version string) string {
+		for _, snapshot := range snapshots {
+			if strconv.Itoa(snapshot.Number) == version {
+				return snapshot.SHA
+			}
+		}
+		clitools.UserErrorStr("RangeDiff", "there is no version %v of the %v stack, see `git-ext stack history`", version, branch)
+		return ""
+	}
+
+	head, err := git.GetSha("HEAD")
+	clitools.UserError(err)
+
+	// Rewrites record the new HEAD as well, so by default the comparison is with the last
+	// version that differs from HEAD.
+	var oldSha, newSha string
+	switch {
+	case cli.rangeDiffOld != "" && cli.rangeDiffNew != "":
+		oldSha, newSha = resolve(cli.rangeDiffOld), resolve(cli.rangeDiffNew)
+	case cli.rangeDiffOld != "":
+		oldSha = resolve(cli.rangeDiffOld)
+	default:
+		for idx := len(snapshots) - 1; idx >= 0 && oldSha == ""; idx-- {
+			if snapshots[idx].SHA != head {
+				oldSha = snapshots[idx].SHA
+			}
+		}
+		if oldSha == "" {
+			clitools.UserErrorStr("RangeDiff", "no earlier versions of the %v stack were recorded yet", branch)
+		}
+	}
+	if newSha == "" {
+		newSha = head
+	}
+
+	upstreamName, err := upstreamWithFlag(cli.upstreamOverride)
+	clitools.UserError(err)
+	oldSt, err := loadStackAt(upstreamName, oldSha)
+	clitools.UserError(err)
+	newSt, err := loadStackAt(upstreamName, newSha)
+	clitools.UserError(err)
+
+	var out bytes.Buffer
+	err = git.Cmd("range-diff", "--no-color", oldSt.Base+".."+oldSha, newSt.Base+".."+newSha).
+		PipeStdout(&out).PipeStderr(os.Stderr).
+		Run().Err()
+	clitools.UserError(err)
+
+	scheme, err := currentLabelScheme()
+	clitools.UserError(err)
+	labels, err := scheme.bySHA()
+	clitools.UserError(err)
+
+	scanner := bufio.NewScanner(&out)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		groups := rangeDiffHeaderPattern.FindStringSubmatch(line)
+		if groups == nil {
+			fmt.Println(line)
+			continue
+		}
+
+		label := labelForAbbrev(labels, groups[3])
+		if label == "" {
+			label = labelForAbbrev(labels, groups[2])
+		}
+		if label == "" {
+			label = "-"
+		}
+		fmt.Printf("%v [%v] %v\n", groups[1], label, groups[4])
+	}
+	return scanner.Err()
+}
+
+// labelForAbbrev returns the first label of the commit with the abbreviated SHA.
+func labelForAbbrev(labels map[string][]string, abbrev string) string {
+	if strings.Trim(abbrev, "-") == "" {
+		return ""
+	}
+	for sha, names := range labels {
+		if strings.HasPrefix(sha, abbrev) && len(names) > 0 {
+			return names[0]
+		}
+	}
+	return ""
+}
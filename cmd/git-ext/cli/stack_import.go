@@ -0,0 +1,203 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// importedRevisionTrailer replaces the revision trailers of imported commits when asked to, so
+// that sending them for review creates new revisions instead of updating the ones of the author.
+const importedRevisionTrailer = "Imported-From:"
+
+// bracketMetaPattern matches titles ending in a bare "[meta]" suffix, as opposed to the
+// "title | [meta]" form used by git-ext.
+var bracketMetaPattern = regexp.MustCompile(`^(.*\S)\s+\[([^\]]+)]$`)
+
+var importRevisionPattern = regexp.MustCompile(`(?m)^Differential Revision:[ \t]*(.+)$`)
+
+var patchSubjectPattern = regexp.MustCompile(`(?m)^Subject:\s*(?:\[PATCH[^\]]*]\s*)?(.*)$`)
+
+// doImport applies a patch series onto the upstream as a new stack branch, keeping the
+// authorship of the patches. Patches that do not apply are skipped and reported. If `git am`
+// fails otherwise, the new branch is removed and the original one checked out again.
+func (cli *stackCLI) doImport(ctx *kingpin.ParseContext) error {
+	if git.IsRebaseInProgress() {
+		clitools.UserErrorStr("Import", "a rebase or am is in progress, finish or abort it first")
+	}
+
+	patches, err := importPatchFiles(cli.importSource)
+	clitools.UserError(err)
+
+	branch := cli.importBranch
+	if branch == "" {
+		branch = "import/" + strings.TrimSuffix(filepath.Base(cli.importSource), filepath.Ext(cli.importSource))
+	}
+	if _, err := git.GetSha("refs/heads/" + branch); err == nil {
+		clitools.UserErrorStr("Import", "branch %v already exists, pick another one with --branch", branch)
+	}
+
+	upstreamName, err := upstreamWithFlag(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	origBranch, _ := git.GetCurrentBranch()
+	if origBranch == "" {
+		origBranch, err = git.GetSha("HEAD")
+		clitools.UserError(err)
+	}
+
+	clitools.UserError(
+		git.Cmd("checkout", "--quiet", "--track", "-b", branch, upstreamName).
+			PipeStderr(os.Stderr).
+			Run().Err(),
+	)
+	fmt.Printf("Importing onto %v as %v\n", upstreamName, branch)
+
+	args := []interface{}{"am", "--3way", "--quiet"}
+	for _, patch := range patches {
+		args = append(args, patch)
+	}
+	err = git.Cmd(args...).PipeStdout(os.Stdout).Run().Err()
+
+	// Every stop of `git am` is either the cover letter, which has no patch, or a patch that
+	// does not apply. Both are skipped.
+	var failed []string
+	for err != nil && git.IsRebaseInProgress() {
+		subject, empty, patchErr := currentAmPatch()
+		if patchErr != nil {
+			err = patchErr
+			break
+		}
+		if !empty {
+			failed = append(failed, subject)
+		}
+		err = git.Cmd("am", "--skip", "--quiet").PipeStdout(os.Stdout).Run().Err()
+	}
+	if err != nil {
+		if cleanupErr := abandonImport(origBranch, branch); cleanupErr != nil {
+			fmt.Printf("Could not remove %v: %v\n", branch, cleanupErr)
+		}
+		clitools.UserError(err)
+	}
+
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	_, err = replayStack(st, st.Commits, func(commit *git.Commit) error {
+		var err error
+		commit.Message, err = git.CleanupMessage(importMessage(commit.Message, cli.importDetachRevisions), false)
+		return err
+	}, "stack import")
+	clitools.UserError(err)
+
+	if !labelsPerBranch() {
+		fmt.Printf("Labels are shared by all stacks, they now point at %v (set git-ext.labelPerBranch to keep them per stack)\n", branch)
+	}
+	clitools.UserError(cli.doLabel(ctx))
+
+	if len(failed) > 0 {
+		fmt.Println("\nSkipped, could not be applied:")
+		for _, subject := range failed {
+			fmt.Printf("  %v\n", subject)
+		}
+	}
+	return nil
+}
+
+// abandonImport stops `git am` if it is still running, checks out the branch or commit the
+// import started from and deletes the import branch.
+func abandonImport(origBranch, branch string) error {
+	if git.IsRebaseInProgress() {
+		if err := git.Cmd("am", "--abort").Run().Err(); err != nil {
+			return err
+		}
+	}
+	err := git.Cmd("checkout", "--quiet", origBranch).PipeStderr(os.Stderr).Run().Err()
+	if err != nil {
+		return err
+	}
+	if err := git.RawUnSetBranch(branch, true).Run().Err(); err != nil {
+		return err
+	}
+	fmt.Printf("Removed %v, back on %v\n", branch, origBranch)
+	return nil
+}
+
+// importPatchFiles lists the patches to apply. A directory is read in the order of its quilt
+// series file if it has one, or else by file name.
+func importPatchFiles(source string) ([]string, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{source}, nil
+	}
+
+	series, err := ioutil.ReadFile(filepath.Join(source, "series"))
+	if err == nil {
+		var patches []string
+		for _, line := range strings.Split(string(series), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				patches = append(patches, filepath.Join(source, strings.Fields(line)[0]))
+			}
+		}
+		return patches, nil
+	}
+
+	patches, err := filepath.Glob(filepath.Join(source, "*.patch"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(patches)
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("no patches found in %v", source)
+	}
+	return patches, nil
+}
+
+// currentAmPatch returns the subject of the patch `git am` stopped at, and whether it has no
+// changes at all.
+func currentAmPatch() (string, bool, error) {
+	patchPath, err := git.GetGitPath("rebase-apply/patch")
+	if err != nil {
+		return "", false, err
+	}
+	patch, _ := ioutil.ReadFile(patchPath)
+
+	raw, err := git.Cmd("am", "--show-current-patch=raw").Run().Value()
+	if err != nil {
+		return "", false, err
+	}
+
+	subject := "(unknown patch)"
+	if groups := patchSubjectPattern.FindStringSubmatch(raw); groups != nil {
+		subject = groups[1]
+	}
+	return subject, len(strings.TrimSpace(string(patch))) == 0, nil
+}
+
+// importMessage turns a bare "[meta]" title suffix into git-ext metadata, and when told to
+// detach them, turns revision trailers into references to the original revisions.
+func importMessage(message string, detachRevisions bool) string {
+	title, meta, body := metadataFromString(message)
+	if meta == "" {
+		if groups := bracketMetaPattern.FindStringSubmatch(title); groups != nil {
+			title, meta = groups[1], groups[2]
+		}
+	}
+
+	if detachRevisions {
+		body = importRevisionPattern.ReplaceAllString(body, importedRevisionTrailer+" $1")
+	}
+	return metadataToString(title, meta, body)
+}
@@ -0,0 +1,258 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	defaultLabelPrefix = "D/"
+
+	// hiddenLabelPrefix is where labels live when kept out of the branch list, they resolve
+	// with their short name, e.g. `git rev-parse stack/03`.
+	hiddenLabelPrefix = "stack/"
+)
+
+var labelSuffixPattern = regexp.MustCompile(`^(.*/)?\d+$`)
+
+// labelScheme names the labels of a single stack. Labels are branches named after the prefix
+// from `git-ext.labelPrefix` (default "D/") and the position of the commit, e.g. D/03. With
+// `git-ext.labelPerBranch` set the name of the stack branch goes in between, e.g. D/feature/03,
+// so that every stack keeps its own labels.
+//
+// With `git-ext.hiddenLabels` set new labels are written as refs/stack/03 instead, which stays
+// out of `git branch`. Labels are read from both places.
+type labelScheme struct {
+	Prefix       string
+	HiddenPrefix string
+	Hidden       bool
+}
+
+func labelSchemeFor(branch string) labelScheme {
+	scheme := labelScheme{
+		Prefix:       labelPrefix(),
+		HiddenPrefix: hiddenLabelPrefix,
+		Hidden:       git.GetConfigBool("git-ext.hiddenLabels", false),
+	}
+	if branch != "" && labelsPerBranch() {
+		scheme.Prefix = scheme.Prefix + branch + "/"
+		scheme.HiddenPrefix = scheme.HiddenPrefix + branch + "/"
+	}
+	return scheme
+}
+
+// labelsPerBranch reports whether every stack has its own labels. It is opt-in, by default
+// all stacks share the same labels.
+func labelsPerBranch() bool {
+	return git.GetConfigBool("git-ext.labelPerBranch", false)
+}
+
+// currentLabelScheme returns the label scheme of the stack HEAD is on. The stack branch is
+// only looked up when labels are kept per branch.
+func currentLabelScheme() (labelScheme, error) {
+	if !labelsPerBranch() {
+		return labelSchemeFor(""), nil
+	}
+	branch, err := stackBranch()
+	if err != nil {
+		return labelScheme{}, err
+	}
+	return labelSchemeFor(branch), nil
+}
+
+func labelPrefix() string {
+	prefix, err := git.GetConfig("git-ext.labelPrefix")
+	if err != nil || prefix == "" {
+		return defaultLabelPrefix
+	}
+	return prefix
+}
+
+// isLabelBranch reports whether the branch is a label of any stack.
+func isLabelBranch(name string) bool {
+	prefix := labelPrefix()
+	return strings.HasPrefix(name, prefix) && labelSuffixPattern.MatchString(strings.TrimPrefix(name, prefix))
+}
+
+func (s labelScheme) name(number int) string {
+	if s.Hidden {
+		return fmt.Sprintf("%s%02d", s.HiddenPrefix, number)
+	}
+	return fmt.Sprintf("%s%02d", s.Prefix, number)
+}
+
+func (s labelScheme) isLabel(name string) bool {
+	for _, prefix := range []string{s.Prefix, s.HiddenPrefix} {
+		number := strings.TrimPrefix(name, prefix)
+		if strings.HasPrefix(name, prefix) && len(number) > 0 && strings.Trim(number, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// ref returns the full ref of the label.
+func (s labelScheme) ref(name string) string {
+	if strings.HasPrefix(name, s.HiddenPrefix) {
+		return "refs/" + name
+	}
+	return "refs/heads/" + name
+}
+
+// list maps the names of the labels of the stack to the SHA they point at.
+func (s labelScheme) list() (map[string]string, error) {
+	labels := map[string]string{}
+	for _, namespace := range []string{"refs/heads/" + s.Prefix, "refs/" + s.HiddenPrefix} {
+		refs, err := git.ListRefs(namespace)
+		if err != nil {
+			return nil, err
+		}
+
+		for ref, sha := range refs {
+			name := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/")
+			if s.isLabel(name) {
+				labels[name] = sha
+			}
+		}
+	}
+	return labels, nil
+}
+
+// lookup returns the SHA the label with the given number points at.
+func (s labelScheme) lookup(number string) (string, bool) {
+	labels, err := s.list()
+	if err != nil {
+		return "", false
+	}
+	for name, sha := range labels {
+		if labelNumber(name) == atoiOr(number, -1) {
+			return sha, true
+		}
+	}
+	return "", false
+}
+
+// bySHA maps commit SHAs to the labels of the stack pointing at them.
+func (s labelScheme) bySHA() (map[string][]string, error) {
+	labels, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+
+	bySHA := map[string][]string{}
+	for name, sha := range labels {
+		bySHA[sha] = append(bySHA[sha], name)
+	}
+	for _, names := range bySHA {
+		sort.Strings(names)
+	}
+	return bySHA, nil
+}
+
+func (s labelScheme) set(name, sha string) error {
+	if strings.HasPrefix(name, s.HiddenPrefix) {
+		return git.RawSetRef(s.ref(name), sha).Run().Err()
+	}
+	return git.RawSetBranch(sha, name, true).PipeStdout(os.Stdout).Run().Err()
+}
+
+func (s labelScheme) delete(name string) error {
+	if strings.HasPrefix(name, s.HiddenPrefix) {
+		return git.RawDeleteRef(s.ref(name)).Run().Err()
+	}
+	return git.RawUnSetBranch(name, true).PipeStdout(os.Stdout).Run().Err()
+}
+
+// move points labels at the commits their old targets were rewritten to, labels of removed
+// commits are deleted and all other labels are left alone.
+func (s labelScheme) move(rewritten map[string]string, removed []string) error {
+	labels, err := s.list()
+	if err != nil {
+		return err
+	}
+
+	isRemoved := map[string]bool{}
+	for _, sha := range removed {
+		isRemoved[sha] = true
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sha := labels[name]
+		if newSha, ok := rewritten[sha]; ok && newSha != sha {
+			fmt.Printf("Moving label: %v %v -> %v\n", name, sha[:7], newSha[:7])
+			err = s.set(name, newSha)
+		} else if isRemoved[sha] {
+			fmt.Printf("Removing label: %v (%v)\n", name, sha[:7])
+			err = s.delete(name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// doLabelMigrate moves the branch labels of every stack to hidden refs, D/feature/03 becoming
+// refs/stack/feature/03, and makes hidden labels the default from then on.
+func (cli *stackCLI) doLabelMigrate(ctx *kingpin.ParseContext) error {
+	prefix := labelPrefix()
+
+	branches, err := git.ListRefs("refs/heads/" + prefix)
+	clitools.UserError(err)
+
+	for ref, sha := range branches {
+		branchName := strings.TrimPrefix(ref, "refs/heads/")
+		if !isLabelBranch(branchName) {
+			continue
+		}
+
+		hiddenRef := "refs/" + hiddenLabelPrefix + strings.TrimPrefix(branchName, prefix)
+		fmt.Printf("Migrating label: %v -> %v\n", branchName, hiddenRef)
+		clitools.UserError(git.RawSetRef(hiddenRef, sha).Run().Err())
+		clitools.UserError(git.RawUnSetBranch(branchName, true).Run().Err())
+	}
+
+	clitools.UserError(git.Cmd("config", "git-ext.hiddenLabels", "true").Run().Err())
+	return nil
+}
+
+// resolveCommit resolves a commit argument to a SHA. Besides anything `git rev-parse` accepts,
+// a bare number refers to the label of the current stack with that number.
+func resolveCommit(ref string) (string, error) {
+	if len(ref) > 0 && len(ref) <= 3 && strings.Trim(ref, "0123456789") == "" {
+		if scheme, err := currentLabelScheme(); err == nil {
+			if sha, ok := scheme.lookup(ref); ok {
+				return sha, nil
+			}
+		}
+	}
+	return git.GetSha(ref)
+}
+
+// labelHints offers the labels of the current stack for completion of commit arguments.
+func labelHints() (choices []string) {
+	scheme, err := currentLabelScheme()
+	if err != nil {
+		return nil
+	}
+
+	labels, _ := scheme.list()
+	for name := range labels {
+		choices = append(choices, name)
+	}
+	sort.Strings(choices)
+	return
+}
@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/arc"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+type stackListEntry struct {
+	Index    int    `json:"index"`
+	SHA      string `json:"sha"`
+	Label    string `json:"label"`
+	Title    string `json:"title"`
+	Meta     string `json:"meta"`
+	Revision string `json:"revision"`
+	Stat     string `json:"stat"`
+	Tested   bool   `json:"tested"`
+}
+
+func (cli *stackCLI) doList(ctx *kingpin.ParseContext) error {
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	scheme, err := currentLabelScheme()
+	clitools.UserError(err)
+
+	labels, err := scheme.bySHA()
+	clitools.UserError(err)
+
+	cache, err := loadTestCache()
+	clitools.UserError(err)
+
+	entries := make([]stackListEntry, 0, len(st.Commits))
+	for idx, sha := range st.Commits {
+		message, err := git.GetCommitWithFormat(sha, "%B")
+		clitools.UserError(err)
+
+		stat, err := git.GetCommitShortStat(sha)
+		clitools.UserError(err)
+
+		tree, err := git.GetSha(sha + "^{tree}")
+		clitools.UserError(err)
+
+		title, meta, _ := metadataFromString(message)
+
+		var label string
+		if names := labels[sha]; len(names) > 0 {
+			label = names[0]
+		}
+
+		entries = append(entries, stackListEntry{
+			Index:    idx + 1,
+			SHA:      sha,
+			Label:    label,
+			Title:    title,
+			Meta:     meta,
+			Revision: arc.FindRevision(message),
+			Stat:     strings.TrimSpace(stat),
+			Tested:   cache.passedAny(tree),
+		})
+	}
+
+	if cli.listJSONFlag {
+		out, err := json.MarshalIndent(entries, "", "  ")
+		clitools.UserError(err)
+
+		fmt.Println(string(out))
+		return nil
+	}
+
+	// Print the top of the stack first, the same way `git log` would. Commits whose tree
+	// passed `stack exec` are ticked.
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\t  SHA\tLABEL\tMETA\tREVISION\tSTAT\tTITLE")
+	for idx := len(entries) - 1; idx >= 0; idx-- {
+		e := entries[idx]
+		tick := " "
+		if e.Tested {
+			tick = "✓"
+		}
+		fmt.Fprintf(w, "%02d\t%s %s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Index, tick, e.SHA[:7], orDash(e.Label), orDash(e.Meta), orDash(e.Revision), orDash(e.Stat), e.Title,
+		)
+	}
+	return w.Flush()
+}
+
+func orDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func (cli *stackCLI) doMove(ctx *kingpin.ParseContext) error {
+	if (cli.moveBeforeRef == "") == (cli.moveAfterRef == "") {
+		clitools.UserErrorStr("Move", "exactly one of --before or --after is required")
+	}
+
+	targetSha, err := resolveCommit(cli.moveTargetRef)
+	clitools.UserError(err)
+
+	after := cli.moveAfterRef != ""
+	anchorRef := cli.moveBeforeRef
+	if after {
+		anchorRef = cli.moveAfterRef
+	}
+	anchorSha, err := resolveCommit(anchorRef)
+	clitools.UserError(err)
+
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	targetIdx, anchorIdx := st.indexOf(targetSha), st.indexOf(anchorSha)
+	if targetIdx < 0 {
+		clitools.UserErrorStr("Move", "%v is not on the stack", targetSha[:7])
+	}
+	if anchorIdx < 0 {
+		clitools.UserErrorStr("Move", "%v is not on the stack", anchorSha[:7])
+	}
+	if targetIdx == anchorIdx {
+		clitools.UserErrorStr("Move", "can not move %v relative to itself", targetSha[:7])
+	}
+
+	reordered := moveItem(st.Commits, targetIdx, anchorIdx, after)
+	if strings.Join(reordered, " ") == strings.Join(st.Commits, " ") {
+		fmt.Printf("%v is already in place\n", targetSha[:7])
+		return nil
+	}
+
+	rewritten, err := replayStack(st, reordered, nil, "stack move "+targetSha[:7])
+	if _, ok := err.(*git.ConflictError); ok {
+		rewritten, err = cli.moveInWorktree(targetSha, anchorSha, after, reordered)
+	}
+	clitools.UserError(err)
+
+	scheme, err := currentLabelScheme()
+	clitools.UserError(err)
+	clitools.UserError(scheme.move(rewritten, nil))
+
+	fmt.Printf("Moved %v -> %v\n", targetSha[:7], rewritten[targetSha][:7])
+	return nil
+}
+
+// moveInWorktree reorders the stack with a rebase in the working tree, which is only needed
+// when the commits do not replay cleanly in the new order. On conflict the rebase is aborted.
+func (cli *stackCLI) moveInWorktree(targetSha, anchorSha string, after bool, reordered []string) (map[string]string, error) {
+	rewrite := todoRewrite{Action: "pick", MoveBefore: anchorSha}
+	if after {
+		rewrite = todoRewrite{Action: "pick", MoveAfter: anchorSha}
+	}
+
+	err := cli.startTodoRebase(targetSha, rewrite)
+	if err != nil {
+		if git.IsRebaseInProgress() {
+			git.Cmd("rebase", "--abort").Run()
+			clitools.UserErrorStr("Move", "moving %v conflicts, the rebase was aborted and HEAD restored", targetSha[:7])
+		}
+		return nil, err
+	}
+
+	newSt, err := loadStack(cli.upstreamOverride)
+	if err != nil {
+		return nil, err
+	}
+	if len(newSt.Commits) != len(reordered) {
+		clitools.UserErrorStr("Move", "the stack changed shape unexpectedly, relabel with `git-ext stack label`")
+	}
+
+	rewritten := map[string]string{}
+	for idx, sha := range reordered {
+		rewritten[sha] = newSt.Commits[idx]
+	}
+	return rewritten, nil
+}
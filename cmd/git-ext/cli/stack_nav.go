@@ -0,0 +1,130 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/rebasetodo"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func (cli *stackCLI) doNext(ctx *kingpin.ParseContext) error {
+	if git.IsRebaseInProgress() {
+		return cli.stepRebase(false)
+	}
+	return cli.navigate(func(current, size int) (int, error) {
+		if current+1 >= size {
+			return 0, fmt.Errorf("already at the top of the stack")
+		}
+		return current + 1, nil
+	})
+}
+
+func (cli *stackCLI) doPrev(ctx *kingpin.ParseContext) error {
+	if git.IsRebaseInProgress() {
+		clitools.UserErrorStr("Navigate", "can not move backwards while a rebase is in progress")
+	}
+	return cli.navigate(func(current, size int) (int, error) {
+		if current <= 0 {
+			return 0, fmt.Errorf("already at the bottom of the stack")
+		}
+		return current - 1, nil
+	})
+}
+
+func (cli *stackCLI) doTop(ctx *kingpin.ParseContext) error {
+	if git.IsRebaseInProgress() {
+		return cli.stepRebase(true)
+	}
+	return cli.navigate(func(current, size int) (int, error) {
+		return size - 1, nil
+	})
+}
+
+func (cli *stackCLI) doBottom(ctx *kingpin.ParseContext) error {
+	if git.IsRebaseInProgress() {
+		clitools.UserErrorStr("Navigate", "can not move backwards while a rebase is in progress")
+	}
+	return cli.navigate(func(current, size int) (int, error) {
+		return 0, nil
+	})
+}
+
+// navigate checks out the stack commit chosen by pick, given the position of HEAD on the
+// stack (-1 when HEAD is at the merge base). The top of the stack is checked out as the
+// branch itself rather than as a detached HEAD.
+func (cli *stackCLI) navigate(pick func(current, size int) (int, error)) error {
+	branch, err := stackBranch()
+	clitools.UserError(err)
+
+	st, err := loadBranchStack(cli.upstreamOverride, branch)
+	clitools.UserError(err)
+
+	if len(st.Commits) == 0 {
+		clitools.UserErrorStr("Navigate", "there are no commits on the stack of %v", branch)
+	}
+
+	headSha, err := git.GetSha("HEAD")
+	clitools.UserError(err)
+
+	current := st.indexOf(headSha)
+	if current < 0 && headSha != st.Base {
+		clitools.UserErrorStr("Navigate", "HEAD is not on the stack of %v", branch)
+	}
+
+	target, err := pick(current, len(st.Commits))
+	clitools.UserError(err)
+
+	sha := st.Commits[target]
+	checkoutArgs := []interface{}{"checkout", "--detach", sha}
+	if target == len(st.Commits)-1 {
+		checkoutArgs = []interface{}{"checkout", branch}
+	}
+	clitools.UserError(
+		git.Cmd(checkoutArgs...).
+			PipeStderr(os.Stderr).
+			Run().Err(),
+	)
+
+	title, err := git.GetCommitWithFormat(sha, "%s")
+	clitools.UserError(err)
+
+	fmt.Printf("%02d/%02d| %v %v\n", target+1, len(st.Commits), sha[:7], title)
+	return nil
+}
+
+// stepRebase continues an ongoing rebase. Unless running to the end, the next picked commit
+// is turned into an edit so that the rebase stops right after applying it.
+func (cli *stackCLI) stepRebase(toEnd bool) error {
+	todoFile, err := git.GetGitPath("rebase-merge/git-rebase-todo")
+	clitools.UserError(err)
+
+	if _, err := os.Stat(todoFile); err == nil {
+		todo, err := rebasetodo.ReadFile(todoFile)
+		clitools.UserError(err)
+
+		stopping := false
+		for _, entry := range todo.Commands() {
+			switch {
+			case toEnd && entry.Action == rebasetodo.Edit:
+				entry.Action = rebasetodo.Pick
+			case toEnd || stopping:
+			case entry.Action == rebasetodo.Edit || entry.Action == rebasetodo.Break:
+				stopping = true
+			case entry.Action == rebasetodo.Pick:
+				stopping = true
+				entry.Action = rebasetodo.Edit
+			}
+		}
+		clitools.UserError(todo.WriteFile(todoFile))
+	}
+
+	clitools.UserError(
+		git.Cmd("rebase", "--continue").
+			PipeStdout(os.Stdout).PipeStderr(os.Stderr).
+			Run().Err(),
+	)
+	return nil
+}
@@ -0,0 +1,312 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/arc"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// doReword replaces the message of a commit of the stack, from -m or an editor. Only messages
+// change, so the descendants are replayed without touching the working tree.
+func (cli *stackCLI) doReword(ctx *kingpin.ParseContext) error {
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	switch {
+	case cli.rewordAll && (cli.rewordTargetRef != "" || cli.rewordMessage != ""):
+		clitools.UserErrorStr("Reword", "--all can not be combined with a target or -m")
+	case cli.rewordAll:
+		return cli.doRewordAll(st)
+	case cli.rewordTargetRef == "":
+		clitools.UserErrorStr("Reword", "a target commit or --all is required")
+	case cli.rewordStrict:
+		clitools.UserErrorStr("Reword", "--strict only applies to --all")
+	}
+
+	targetSha, err := st.findCommit(cli.rewordTargetRef)
+	clitools.UserError(err)
+
+	oldMessage, err := git.GetCommitWithFormat(targetSha, "%B")
+	clitools.UserError(err)
+
+	message := cli.rewordMessage
+	if message == "" || cli.rewordEdit {
+		initial := message
+		if initial == "" {
+			initial = oldMessage
+		}
+		message, err = editMessage("REWORD_MSG", initial, fmt.Sprintf(
+			"# Rewording %v. Lines starting with '#' are ignored, an empty message aborts.\n", targetSha[:7],
+		))
+		clitools.UserError(err)
+	}
+	if strings.TrimSpace(message) == "" {
+		clitools.UserErrorStr("Reword", "empty message, %v was left as is", targetSha[:7])
+	}
+
+	message, err = rewordMessage(oldMessage, message, cli.rewordKeepMeta)
+	clitools.UserError(err)
+
+	rewritten, err := replayStack(st, st.Commits, func(commit *git.Commit) error {
+		if commit.SHA == targetSha {
+			commit.Message = message
+		}
+		return nil
+	}, "stack reword "+targetSha[:7])
+	clitools.UserError(err)
+
+	scheme, err := currentLabelScheme()
+	clitools.UserError(err)
+	clitools.UserError(scheme.move(rewritten, nil))
+
+	if newSha, ok := rewritten[targetSha]; ok {
+		fmt.Printf("Reworded %v -> %v\n", targetSha[:7], newSha[:7])
+	} else {
+		fmt.Printf("The message of %v is unchanged\n", targetSha[:7])
+	}
+	return nil
+}
+
+// rewordMessage completes a new message for a commit. Unless the new title has metadata of
+// its own, the old metadata is kept when keepMeta is set. The trailers of the old message are
+// kept unless the new message sets them itself, so the revision and the Change-Id the stable
+// labels are keyed on stay with the commit. The revision line is kept even when it is not in a
+// paragraph of trailers, as arc finds it anywhere in the message.
+func rewordMessage(oldMessage, newMessage string, keepMeta bool) (string, error) {
+	_, oldMeta, _ := metadataFromString(oldMessage)
+	title, meta, body := metadataFromString(strings.TrimSpace(newMessage))
+	if meta == "" && keepMeta {
+		meta = oldMeta
+	}
+
+	message, err := git.CleanupMessage(metadataToString(title, meta, body), false)
+	if err != nil {
+		return "", err
+	}
+
+	if revision := arc.FindRevision(oldMessage); revision != "" && arc.FindRevision(message) == "" {
+		message = strings.TrimRight(message, "\n") + "\n\nDifferential Revision: " + revision + "\n"
+	}
+	return restoreTrailers(oldMessage, message), nil
+}
+
+// editMessage opens the message in the editor, in a file under .git/git-ext, and returns the
+// edited message without comments. The help comment is appended after the message.
+func editMessage(name string, message string, help string) (string, error) {
+	edited, _, err := editBuffer(name, strings.TrimRight(message, "\n")+"\n\n"+help)
+	if err != nil {
+		return "", err
+	}
+	return git.CleanupMessage(edited, true)
+}
+
+// editBuffer opens the content in the editor, in a file under .git/git-ext, and returns the
+// content as it was saved along with the path of the file.
+func editBuffer(name string, content string) (string, string, error) {
+	bufferFile, err := extDataPath(name)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := ioutil.WriteFile(bufferFile, []byte(content), 0666); err != nil {
+		return "", "", err
+	}
+	if err := git.EditFile(bufferFile); err != nil {
+		return "", "", err
+	}
+
+	edited, err := ioutil.ReadFile(bufferFile)
+	if err != nil {
+		return "", "", err
+	}
+	return string(edited), bufferFile, nil
+}
+
+// rewordMarkerPrefix starts the lines separating the messages in the `reword --all` buffer,
+// rewordMarkerPattern matches them when intact, with SHA-1 or SHA-256 object names.
+const rewordMarkerPrefix = "=== commit "
+
+var rewordMarkerPattern = regexp.MustCompile(`^=== commit ([0-9a-f]{40}|[0-9a-f]{64})(?: \S+)? ===$`)
+
+// trailerPattern matches trailer lines, allowing spaces in the key as Phabricator does.
+var trailerPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9 -]*:\s`)
+
+// doRewordAll edits the messages of the whole stack in a single editor buffer, one section per
+// commit, and applies them in one replay. The buffer is refused if the section markers were
+// changed, as messages could end up on the wrong commits. Only the help at the top of the
+// buffer is dropped, comment lines in the messages are kept, and commits whose section was
+// left alone keep their message as is.
+func (cli *stackCLI) doRewordAll(st *stack) error {
+	if len(st.Commits) == 0 {
+		clitools.UserErrorStr("Reword", "the stack is empty")
+	}
+
+	scheme, err := currentLabelScheme()
+	clitools.UserError(err)
+	labels, err := scheme.bySHA()
+	clitools.UserError(err)
+
+	oldMessages := map[string]string{}
+	var buffer strings.Builder
+	fmt.Fprintln(&buffer, "# Edit the messages of the stack, from the bottom to the top. Only the lines above")
+	fmt.Fprintln(&buffer, "# the first marker are ignored. Do not change, remove or reorder the '=== commit' lines.")
+	for _, sha := range st.Commits {
+		message, err := git.GetCommitWithFormat(sha, "%B")
+		clitools.UserError(err)
+		oldMessages[sha] = message
+
+		marker := rewordMarkerPrefix + sha
+		if names := labels[sha]; len(names) > 0 {
+			marker += " " + names[0]
+		}
+		fmt.Fprintf(&buffer, "\n%v ===\n\n%v\n", marker, strings.TrimRight(message, "\n"))
+	}
+
+	edited, bufferFile, err := editBuffer("REWORD_ALL", buffer.String())
+	clitools.UserError(err)
+
+	sections, err := parseRewordBuffer(edited, st.Commits)
+	if err != nil {
+		clitools.UserErrorStr("Reword", "%v, nothing was changed, the buffer is kept in %v", err, bufferFile)
+	}
+
+	messages := map[string]string{}
+	for _, sha := range st.Commits {
+		message, err := git.CleanupMessage(sections[sha], false)
+		clitools.UserError(err)
+		if strings.TrimSpace(message) == "" {
+			clitools.UserErrorStr("Reword", "empty message for %v, nothing was changed, the buffer is kept in %v", sha[:7], bufferFile)
+		}
+
+		if cli.rewordStrict {
+			message = restoreTrailers(oldMessages[sha], message)
+		}
+		oldMessage, err := git.CleanupMessage(oldMessages[sha], false)
+		clitools.UserError(err)
+		if message != oldMessage {
+			messages[sha] = message
+		}
+	}
+
+	rewritten, err := replayStack(st, st.Commits, func(commit *git.Commit) error {
+		if message, ok := messages[commit.SHA]; ok {
+			commit.Message = message
+		}
+		return nil
+	}, "stack reword --all")
+	clitools.UserError(err)
+	clitools.UserError(scheme.move(rewritten, nil))
+
+	fmt.Printf("Reworded %d of %d commits\n", len(messages), len(st.Commits))
+	return nil
+}
+
+// parseRewordBuffer splits the edited `reword --all` buffer into the messages of the commits.
+// The markers have to be intact and in the order of the stack, and nothing but comments may
+// come before the first one. A removed or damaged marker shows up as a missing one.
+func parseRewordBuffer(buffer string, commits []string) (map[string]string, error) {
+	sections := map[string]string{}
+	var current []string
+	sha := ""
+
+	flush := func() {
+		if sha != "" {
+			sections[sha] = strings.Join(current, "\n")
+		}
+		current = nil
+	}
+
+	for _, line := range strings.Split(buffer, "\n") {
+		groups := rewordMarkerPattern.FindStringSubmatch(line)
+		if groups == nil {
+			if sha == "" && strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "#") {
+				return nil, fmt.Errorf("text before the first marker")
+			}
+			current = append(current, line)
+			continue
+		}
+
+		flush()
+
+		if len(sections) >= len(commits) || commits[len(sections)] != groups[1] {
+			return nil, fmt.Errorf("unexpected marker for %v, markers were removed or reordered", groups[1][:7])
+		}
+		sha = groups[1]
+	}
+	flush()
+
+	if len(sections) != len(commits) {
+		return nil, fmt.Errorf("%d of %d markers found", len(sections), len(commits))
+	}
+	return sections, nil
+}
+
+// restoreTrailers adds back the trailers of the old message whose key the new message lacks.
+// A trailer whose value was edited is left as edited.
+func restoreTrailers(oldMessage, newMessage string) string {
+	present := map[string]bool{}
+	newTrailers := messageTrailers(newMessage)
+	for _, trailer := range newTrailers {
+		present[trailerKey(trailer)] = true
+	}
+
+	var missing []string
+	for _, trailer := range messageTrailers(oldMessage) {
+		if !present[trailerKey(trailer)] {
+			missing = append(missing, trailer)
+		}
+	}
+	if len(missing) == 0 {
+		return newMessage
+	}
+
+	separator := "\n\n"
+	if len(newTrailers) > 0 {
+		separator = "\n"
+	}
+	return strings.TrimRight(newMessage, "\n") + separator + strings.Join(missing, "\n") + "\n"
+}
+
+// messageTrailers returns the trailer lines of the message, those of the trailing paragraphs
+// made of trailers only.
+func messageTrailers(message string) []string {
+	_, trailers := splitTrailers(message)
+	return trailers
+}
+
+// splitTrailers splits the message into its text and the trailer lines of the trailing
+// paragraphs made of trailers only. `git interpret-trailers` does not take keys with spaces as
+// trailers, so a trailer added after a revision trailer may end up in a paragraph of its own.
+// The title is never taken as a trailer.
+func splitTrailers(message string) (string, []string) {
+	paragraphs := strings.Split(strings.TrimSpace(message), "\n\n")
+
+	var trailers []string
+	idx := len(paragraphs) - 1
+	for ; idx > 0; idx-- {
+		lines := strings.Split(strings.TrimSpace(paragraphs[idx]), "\n")
+		isTrailers := true
+		for _, line := range lines {
+			if !trailerPattern.MatchString(line) {
+				isTrailers = false
+				break
+			}
+		}
+		if !isTrailers {
+			break
+		}
+		trailers = append(lines, trailers...)
+	}
+	return strings.Join(paragraphs[:idx+1], "\n\n"), trailers
+}
+
+// trailerKey returns the key of a trailer line, compared case-insensitively as git does.
+func trailerKey(trailer string) string {
+	return strings.ToLower(strings.TrimSpace(strings.SplitN(trailer, ":", 2)[0]))
+}
@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/arc"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func (cli *stackCLI) doSplit(ctx *kingpin.ParseContext) error {
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	targetSha, err := st.findCommit(cli.splitTargetRef)
+	clitools.UserError(err)
+
+	target, err := git.GetCommit(targetSha)
+	clitools.UserError(err)
+	if len(target.Parents) == 0 {
+		clitools.UserErrorStr("Split", "%v is a root commit, it can not be split", targetSha[:7])
+	}
+
+	files, err := git.ListCommitFiles(targetSha)
+	clitools.UserError(err)
+
+	groups := groupPaths(files, cli.splitPathGlobs)
+	if len(groups) < 2 {
+		clitools.UserErrorStr("Split", "the globs do not split %v into more than one commit", targetSha[:7])
+	}
+
+	message, err := git.GetCommitWithFormat(targetSha, "%B")
+	clitools.UserError(err)
+	author, err := git.GetCommitWithFormat(targetSha, "%an <%ae>")
+	clitools.UserError(err)
+	authorDate, err := git.GetCommitWithFormat(targetSha, "%aI")
+	clitools.UserError(err)
+
+	state, err := newStackState("split", st)
+	clitools.UserError(err)
+	state.Expanded = map[string]int{targetSha: len(groups)}
+	state.Split = &splitState{
+		Target:  targetSha,
+		Groups:  groups,
+		Message: message,
+		Author:  author,
+		Date:    authorDate,
+	}
+	clitools.UserError(state.save())
+
+	err = cli.startEditRebase(targetSha)
+	state.check("Split", err)
+
+	resumed, err := state.Split.resume()
+	clitools.UserError(err)
+	if !resumed {
+		clitools.UserErrorStr("Split", "rebase did not stop at %v, finish it by hand", targetSha[:7])
+	}
+	state.Split = nil
+	clitools.UserError(state.save())
+
+	err = continueRebase()
+	state.check("Split", err)
+
+	_, _, err = state.finish()
+	clitools.UserError(err)
+	return nil
+}
+
+// groupPaths assigns every path to the first glob group it matches, paths matching no group
+// are collected into a trailing group. Empty groups are dropped.
+func groupPaths(paths []string, globGroups []string) [][]string {
+	groups := make([][]string, len(globGroups)+1)
+	for _, p := range paths {
+		groupIdx := len(globGroups)
+		for idx, globs := range globGroups {
+			if matchPathGlobs(strings.Split(globs, ","), p) {
+				groupIdx = idx
+				break
+			}
+		}
+		groups[groupIdx] = append(groups[groupIdx], p)
+	}
+
+	var nonEmpty [][]string
+	for _, group := range groups {
+		if len(group) > 0 {
+			nonEmpty = append(nonEmpty, group)
+		}
+	}
+	return nonEmpty
+}
+
+// matchPathGlobs matches a path against globs of the full path, of the file name when the
+// glob has no slash, or of a leading directory.
+func matchPathGlobs(globs []string, p string) bool {
+	for _, glob := range globs {
+		glob = strings.TrimSpace(glob)
+		if glob == "" {
+			continue
+		}
+		if ok, _ := path.Match(glob, p); ok {
+			return true
+		}
+		if ok, _ := path.Match(glob, path.Base(p)); ok && !strings.Contains(glob, "/") {
+			return true
+		}
+		if strings.HasPrefix(p, strings.TrimSuffix(glob, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitMessage derives the message of one part of a split commit. The revision trailer stays
+// with the first part only, so that the remaining parts can be sent for review separately.
+func splitMessage(message string, idx int, count int) string {
+	title, meta, body := metadataFromString(message)
+	title = fmt.Sprintf("%s (%d/%d)", title, idx+1, count)
+	if idx > 0 {
+		body = strings.TrimRight(arc.PhabDiffRe.ReplaceAllString(body, ""), "\n")
+	}
+	return metadataToString(title, meta, body)
+}
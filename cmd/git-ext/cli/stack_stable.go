@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const changeIDTrailer = "Change-Id"
+
+var changeIDPattern = regexp.MustCompile(`(?m)^Change-Id:\s*(I[0-9a-fA-F]+)\s*$`)
+var labelNumberPattern = regexp.MustCompile(`(\d+)$`)
+
+// doLabelStable labels the stack by commit identity rather than position. Every commit gets a
+// Change-Id trailer the first time it is labeled, and keeps the label number that was last
+// given to its Change-Id. New commits get numbers past the highest one in use.
+func (cli *stackCLI) doLabelStable(ctx *kingpin.ParseContext) error {
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	rewritten, err := stampChangeIDs(st)
+	clitools.UserError(err)
+
+	scheme, err := currentLabelScheme()
+	clitools.UserError(err)
+	scheme.Hidden = scheme.Hidden || cli.labelHidden
+
+	labels, err := scheme.list()
+	clitools.UserError(err)
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	numbers := map[string]int{}
+	maxNumber := 0
+	for _, name := range names {
+		number := labelNumber(name)
+		if number > maxNumber {
+			maxNumber = number
+		}
+
+		sha := labels[name]
+		if newSha, ok := rewritten[sha]; ok {
+			sha = newSha
+		}
+		message, err := git.GetCommitWithFormat(sha, "%B")
+		clitools.UserError(err)
+
+		if id := changeIDFromMessage(message); id != "" {
+			if _, ok := numbers[id]; !ok {
+				numbers[id] = number
+			}
+		}
+	}
+
+	commits := []string{st.Base}
+	for _, sha := range st.Commits {
+		if newSha, ok := rewritten[sha]; ok {
+			sha = newSha
+		}
+		commits = append(commits, sha)
+	}
+
+	for idx, sha := range commits {
+		number := 0
+		if idx > 0 {
+			message, err := git.GetCommitWithFormat(sha, "%B")
+			clitools.UserError(err)
+
+			id := changeIDFromMessage(message)
+			var ok bool
+			if number, ok = numbers[id]; !ok {
+				maxNumber++
+				number = maxNumber
+				numbers[id] = number
+			}
+		}
+
+		branchName := scheme.name(number)
+		fmt.Printf("%02d| Creating label: %v -> %v\n", idx, branchName, sha)
+		clitools.UserError(scheme.set(branchName, sha))
+	}
+
+	return nil
+}
+
+// stampChangeIDs adds a Change-Id trailer to every commit of the stack lacking one. Only the
+// messages change, so the stack is replayed without touching the working tree. It returns the
+// SHAs of the recreated commits keyed by the original ones.
+func stampChangeIDs(st *stack) (map[string]string, error) {
+	return replayStack(st, st.Commits, func(commit *git.Commit) error {
+		if changeIDFromMessage(commit.Message) != "" {
+			return nil
+		}
+
+		id, err := newChangeID()
+		if err != nil {
+			return err
+		}
+		commit.Message, err = git.AddTrailer(commit.Message, changeIDTrailer, id)
+		return err
+	}, "stack label --stable")
+}
+
+func changeIDFromMessage(message string) string {
+	groups := changeIDPattern.FindStringSubmatch(message)
+	if groups == nil {
+		return ""
+	}
+	return groups[1]
+}
+
+func newChangeID() (string, error) {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return "I" + hex.EncodeToString(id), nil
+}
+
+func labelNumber(name string) int {
+	number, _ := strconv.Atoi(labelNumberPattern.FindString(name))
+	return number
+}
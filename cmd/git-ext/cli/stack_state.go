@@ -0,0 +1,469 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	// relabelByPosition maps the old stack onto the new one commit by commit, skipping
+	// removed commits and accounting for commits that were split into several.
+	relabelByPosition = "position"
+
+	// relabelByPatchID maps commits by their patch-id, for rebases onto a new base.
+	relabelByPatchID = "patch-id"
+)
+
+// stackState is what git-ext needs to finish a command once the rebase it started is done. It
+// is kept in .git/git-ext/state.json while the rebase is stopped.
+type stackState struct {
+	Command  string `json:"command"`
+	Branch   string `json:"branch,omitempty"`
+	Upstream string `json:"upstream"`
+	OrigHead string `json:"origHead"`
+
+	// Base and Commits are the stack before the command, bottom to top.
+	Base    string   `json:"base"`
+	Commits []string `json:"commits"`
+
+	Relabel string `json:"relabel"`
+
+	// Removed commits are expected to be gone after the rebase, their labels are deleted.
+	Removed []string `json:"removed,omitempty"`
+
+	// Expanded commits are expected to be replaced by this many commits.
+	Expanded map[string]int `json:"expanded,omitempty"`
+
+	// Stashed is set when local changes were stashed, they are restored once done.
+	Stashed bool `json:"stashed,omitempty"`
+
+	// TempFiles are removed once done.
+	TempFiles []string `json:"tempFiles,omitempty"`
+
+	// Split holds the pending split of a commit the rebase has yet to stop at.
+	Split *splitState `json:"split,omitempty"`
+
+	// Abandon lists the Phabricator revisions to abandon once done.
+	Abandon []string `json:"abandon,omitempty"`
+}
+
+// newStackState starts the state of a command about to rebase the stack.
+func newStackState(command string, st *stack) (*stackState, error) {
+	branch, _ := stackBranch()
+	origHead, err := git.GetSha("HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if err := snapshotStack("before stack " + command); err != nil {
+		return nil, err
+	}
+	return &stackState{
+		Command:  command,
+		Branch:   branch,
+		Upstream: st.Upstream,
+		OrigHead: origHead,
+		Base:     st.Base,
+		Commits:  st.Commits,
+		Relabel:  relabelByPosition,
+	}, nil
+}
+
+// loadStackState reads the state of the command in progress. A rebase finished with plain
+// `git rebase --continue` still leaves the state to `stack continue`, but once anything else
+// moved HEAD the state no longer describes the stack and is cleared.
+func loadStackState() (*stackState, error) {
+	statePath, err := extDataPath("state.json")
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := &stackState{}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, fmt.Errorf("reading %v: %v", statePath, err)
+	}
+
+	if !git.IsRebaseInProgress() && !rebaseJustFinished() {
+		fmt.Printf("Clearing the state of `git-ext stack %v`, its rebase is no longer running.\n", state.Command)
+		if state.Stashed {
+			fmt.Println("Local changes are kept in the stash, restore them with `git stash pop --index`.")
+		}
+		return nil, state.clear()
+	}
+	return state, nil
+}
+
+// rebaseJustFinished reports whether the last move of HEAD was a rebase finishing.
+func rebaseJustFinished() bool {
+	reason, err := git.Cmd("log", "-g", "-1", "--format=%gs", "HEAD").Run().Value()
+	return err == nil && strings.HasPrefix(reason, "rebase") && strings.Contains(reason, "(finish)")
+}
+
+func (state *stackState) save() error {
+	statePath, err := extDataPath("state.json")
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePath, raw, 0666)
+}
+
+func (state *stackState) clear() error {
+	statePath, err := extDataPath("state.json")
+	if err != nil {
+		return err
+	}
+	for _, file := range state.TempFiles {
+		os.Remove(file)
+	}
+	if err := os.Remove(statePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// check handles an error of the rebase run by the command. A stopped rebase keeps the state in
+// place to be finished with `stack continue`, any other failure drops it.
+func (state *stackState) check(title string, err error) {
+	if err == nil {
+		return
+	}
+	if git.IsRebaseInProgress() {
+		rebaseStopped(title)
+	}
+	state.clear()
+	clitools.UserError(err)
+}
+
+// autosquash squashes the fixup commits on top of the stack into their targets. Local changes
+// are kept in the stash while the rebase runs, and restored with the index intact once done.
+func (state *stackState) autosquash(title string) {
+	dirty, err := git.Cmd("status", "--porcelain", "--untracked-files=no").Run().Value()
+	clitools.UserError(err)
+	if dirty != "" {
+		clitools.UserError(git.Cmd("stash", "push", "--quiet", "-m", "git-ext: "+state.Command).Run().Err())
+		state.Stashed = true
+	}
+	clitools.UserError(state.save())
+
+	err = git.
+		RebaseCmd("true", "-i", "--autosquash", state.Base).
+		PipeStdout(os.Stdout).PipeStderr(os.Stderr).
+		Run().Err()
+	if err != nil && state.Stashed {
+		fmt.Println("Local changes are kept in the stash until the rebase is done.")
+	}
+	state.check(title, err)
+}
+
+func rebaseStopped(title string) {
+	clitools.UserErrorStr(title,
+		"rebase stopped, resolve it and run `git-ext stack continue`, or `git-ext stack abort` to start over",
+	)
+}
+
+// finish completes a command after its rebase is done. It restores stashed changes, moves the
+// labels to the rewritten commits and clears the state. It returns the rewritten commits keyed
+// by the original ones, and the commits that could not be matched.
+func (state *stackState) finish() (map[string]string, []string, error) {
+	if state.Stashed {
+		err := git.Cmd("stash", "pop", "--index", "--quiet").Run().Err()
+		if err != nil {
+			return nil, nil, err
+		}
+		state.Stashed = false
+	}
+
+	newSt, err := loadStackAt(state.Upstream, "HEAD")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rewritten map[string]string
+	var unmatched []string
+	switch state.Relabel {
+	case relabelByPatchID:
+		rewritten, unmatched, err = state.matchByPatchID(newSt)
+	default:
+		rewritten, err = state.matchByPosition(newSt)
+	}
+	if err != nil {
+		// The rebase is done either way, only the labels are left behind.
+		state.clear()
+		return nil, nil, err
+	}
+
+	scheme, err := currentLabelScheme()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := scheme.move(rewritten, state.Removed); err != nil {
+		return nil, nil, err
+	}
+	if err := snapshotStack("stack " + state.Command); err != nil {
+		return nil, nil, err
+	}
+
+	// The stack is rewritten already, a revision that fails to be abandoned is only reported.
+	for _, revision := range state.Abandon {
+		if err := abandonRevision(revision); err != nil {
+			fmt.Printf("Could not abandon %v: %v\n", revision, err)
+		} else {
+			fmt.Printf("Abandoned %v\n", revision)
+		}
+	}
+
+	return rewritten, unmatched, state.clear()
+}
+
+func (state *stackState) matchByPosition(newSt *stack) (map[string]string, error) {
+	isRemoved := map[string]bool{}
+	for _, sha := range state.Removed {
+		isRemoved[sha] = true
+	}
+
+	rewritten := map[string]string{state.Base: newSt.Base}
+	position := 0
+	for _, sha := range state.Commits {
+		if isRemoved[sha] {
+			continue
+		}
+		if position < len(newSt.Commits) {
+			rewritten[sha] = newSt.Commits[position]
+		}
+		if count, ok := state.Expanded[sha]; ok {
+			position += count
+		} else {
+			position++
+		}
+	}
+
+	if position != len(newSt.Commits) {
+		return nil, fmt.Errorf("the stack changed shape unexpectedly, relabel with `git-ext stack label`")
+	}
+	return rewritten, nil
+}
+
+func (state *stackState) matchByPatchID(newSt *stack) (map[string]string, []string, error) {
+	oldPatchIDs, err := git.GetPatchIDs(state.Base, state.OrigHead)
+	if err != nil {
+		return nil, nil, err
+	}
+	newPatchIDs, err := git.GetPatchIDs(newSt.Base, "HEAD")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byPatchID := map[string]string{}
+	for sha, id := range newPatchIDs {
+		byPatchID[id] = sha
+	}
+
+	isRemoved := map[string]bool{}
+	for _, sha := range state.Removed {
+		isRemoved[sha] = true
+	}
+
+	rewritten := map[string]string{state.Base: newSt.Base}
+	var unmatched []string
+	for _, sha := range state.Commits {
+		if newSha, ok := byPatchID[oldPatchIDs[sha]]; ok {
+			rewritten[sha] = newSha
+		} else if !isRemoved[sha] {
+			unmatched = append(unmatched, sha)
+		}
+	}
+	return rewritten, unmatched, nil
+}
+
+func (cli *stackCLI) doContinue(ctx *kingpin.ParseContext) error {
+	state, err := loadStackState()
+	clitools.UserError(err)
+
+	if state == nil {
+		if !git.IsRebaseInProgress() {
+			clitools.UserErrorStr("Continue", "no git-ext command or rebase is in progress")
+		}
+		clitools.UserError(continueRebase())
+		return nil
+	}
+
+	// A pending split keeps the rebase going until it reaches the split target.
+	for git.IsRebaseInProgress() {
+		if state.Split != nil {
+			resumed, err := state.Split.resume()
+			clitools.UserError(err)
+			if resumed {
+				state.Split = nil
+				clitools.UserError(state.save())
+			}
+		}
+
+		if err := continueRebase(); err != nil {
+			if git.IsRebaseInProgress() {
+				rebaseStopped("Continue")
+			}
+			clitools.UserError(err)
+		}
+
+		if state.Split == nil {
+			break
+		}
+	}
+
+	if git.IsRebaseInProgress() {
+		fmt.Println("The rebase stopped again, run `git-ext stack continue` once done.")
+		return nil
+	}
+
+	_, unmatched, err := state.finish()
+	clitools.UserError(err)
+	reportUnmatched(unmatched)
+
+	fmt.Printf("Finished `git-ext stack %v`\n", state.Command)
+	return nil
+}
+
+func (cli *stackCLI) doAbort(ctx *kingpin.ParseContext) error {
+	state, err := loadStackState()
+	clitools.UserError(err)
+
+	if state == nil && !git.IsRebaseInProgress() {
+		clitools.UserErrorStr("Abort", "no git-ext command or rebase is in progress")
+	}
+
+	if git.IsRebaseInProgress() {
+		clitools.UserError(
+			git.Cmd("rebase", "--abort").
+				PipeStdout(os.Stdout).PipeStderr(os.Stderr).
+				Run().Err(),
+		)
+	} else {
+		// The rebase was finished with plain git, its result is undone instead.
+		clitools.UserError(
+			git.Cmd("reset", "--keep", state.OrigHead).
+				PipeStdout(os.Stdout).PipeStderr(os.Stderr).
+				Run().Err(),
+		)
+	}
+
+	if state != nil {
+		if state.Stashed {
+			clitools.UserError(git.Cmd("stash", "pop", "--index", "--quiet").Run().Err())
+		}
+		clitools.UserError(state.clear())
+		fmt.Printf("Aborted `git-ext stack %v`, HEAD is back at %v\n", state.Command, state.OrigHead[:7])
+	}
+	return nil
+}
+
+func (cli *stackCLI) doStatus(ctx *kingpin.ParseContext) error {
+	state, err := loadStackState()
+	clitools.UserError(err)
+
+	if state == nil && !git.IsRebaseInProgress() {
+		fmt.Println("No git-ext command or rebase is in progress.")
+		return nil
+	}
+
+	if state != nil {
+		fmt.Printf("git-ext stack %v in progress, started at %v", state.Command, state.OrigHead[:7])
+		if state.Branch != "" {
+			fmt.Printf(" on %v", state.Branch)
+		}
+		fmt.Println()
+		if state.Stashed {
+			fmt.Println("Local changes are stashed and will be restored once done.")
+		}
+	}
+
+	if git.IsRebaseInProgress() {
+		clitools.UserError(cli.printRebaseProgress(state))
+		fmt.Println("A rebase is stopped, resolve it and run `git-ext stack continue`, or `git-ext stack abort` to start over.")
+	} else {
+		fmt.Println("The rebase is done, run `git-ext stack continue` to finish.")
+	}
+	return nil
+}
+
+// continueRebase continues the stopped rebase, keeping the messages prepared by git-ext.
+func continueRebase() error {
+	return git.
+		RebaseCmd("", "--continue").
+		PipeStdout(os.Stdout).PipeStderr(os.Stderr).
+		Run().Err()
+}
+
+func reportUnmatched(unmatched []string) {
+	if len(unmatched) == 0 {
+		return
+	}
+	fmt.Println("\nCould not match rewritten commits, their labels were left as is:")
+	for _, sha := range unmatched {
+		fmt.Printf("  %v\n", sha[:7])
+	}
+}
+
+// splitState is a split waiting for the rebase to stop at its target.
+type splitState struct {
+	Target  string     `json:"target"`
+	Groups  [][]string `json:"groups"`
+	Message string     `json:"message"`
+	Author  string     `json:"author"`
+	Date    string     `json:"date"`
+}
+
+// resume splits the target if the rebase is stopped at it, reporting whether it did.
+func (split *splitState) resume() (bool, error) {
+	stoppedSha, err := git.GetRebaseEditStop()
+	if err != nil {
+		return false, err
+	}
+	if stoppedSha == "" || !strings.HasPrefix(split.Target, stoppedSha) {
+		return false, nil
+	}
+
+	if err := git.Cmd("reset", "-q", "HEAD^").Run().Err(); err != nil {
+		return false, err
+	}
+
+	for idx, paths := range split.Groups {
+		// The paths are file names, not patterns to be matched.
+		args := []interface{}{"add", "-A", "--"}
+		for _, p := range paths {
+			args = append(args, ":(literal)"+p)
+		}
+		if err := git.Cmd(args...).Run().Err(); err != nil {
+			return false, err
+		}
+
+		partMessage := splitMessage(split.Message, idx, len(split.Groups))
+		err := git.Cmd("commit", "--no-verify", "--file=-", "--author="+split.Author, "--date="+split.Date).
+			PipeStdin(bytes.NewReader([]byte(partMessage))).
+			Run().Err()
+		if err != nil {
+			return false, err
+		}
+
+		fmt.Printf("%02d| %v\n", idx+1, strings.Join(paths, " "))
+	}
+	return true, nil
+}
@@ -0,0 +1,180 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/rebasetodo"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+)
+
+// rebaseProgressEntry is a commit of an ongoing rebase, placed back onto the stack.
+type rebaseProgressEntry struct {
+	Position int
+	Entry    *rebasetodo.Entry
+	SHA      string
+	Label    string
+	Status   string
+}
+
+// printRebaseProgress shows the commits of an ongoing interactive rebase with their stack
+// position and label, and whether they are applied, being edited, conflicting or pending.
+func (cli *stackCLI) printRebaseProgress(state *stackState) error {
+	done, err := readRebaseTodo("rebase-merge/done")
+	if err != nil {
+		return err
+	}
+	todo, err := readRebaseTodo("rebase-merge/git-rebase-todo")
+	if err != nil {
+		return err
+	}
+	if len(done.Commands())+len(todo.Commands()) == 0 {
+		return nil
+	}
+
+	commits, err := cli.rebasedCommits(state)
+	if err != nil {
+		return err
+	}
+
+	scheme, err := currentLabelScheme()
+	if err != nil {
+		return err
+	}
+	labels, err := scheme.bySHA()
+	if err != nil {
+		return err
+	}
+
+	stoppedSha, err := git.GetRebaseEditStop()
+	if err != nil {
+		return err
+	}
+	unmerged, err := git.ListUnmergedFiles()
+	if err != nil {
+		return err
+	}
+
+	var entries []rebaseProgressEntry
+	doneCommands := done.Commands()
+	for idx, entry := range doneCommands {
+		status := "applied"
+		if idx == len(doneCommands)-1 {
+			switch {
+			case len(unmerged) > 0:
+				status = "conflict"
+			case entry.IsCommit() && stoppedSha != "" && sameCommit(entry.Commit, stoppedSha):
+				status = "editing"
+			default:
+				status = "stopped"
+			}
+		}
+		entries = append(entries, rebaseProgressEntry{Entry: entry, Status: status})
+	}
+	for _, entry := range todo.Commands() {
+		entries = append(entries, rebaseProgressEntry{Entry: entry, Status: "pending"})
+	}
+
+	applied, total := 0, 0
+	for idx := range entries {
+		e := &entries[idx]
+		if !e.Entry.IsCommit() {
+			continue
+		}
+		total++
+		if e.Status == "applied" {
+			applied++
+		}
+		for position, sha := range commits {
+			if sameCommit(sha, e.Entry.Commit) {
+				e.Position, e.SHA = position+1, sha
+				if names := labels[sha]; len(names) > 0 {
+					e.Label = names[0]
+				}
+			}
+		}
+	}
+
+	fmt.Printf("Rebase progress, %d of %d commits applied:\n", applied, total)
+
+	// Like `stack list`, the top of the stack comes first.
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tSTATUS\tACTION\tLABEL\tLINE")
+	for idx := len(entries) - 1; idx >= 0; idx-- {
+		e := entries[idx]
+
+		position, label := "-", e.Label
+		if e.Position > 0 {
+			position = fmt.Sprintf("%02d", e.Position)
+		}
+		if label == "" {
+			label = "-"
+		}
+		line := e.Entry.String()
+		if e.Entry.IsCommit() {
+			sha := e.Entry.Commit
+			if len(sha) > 7 {
+				sha = sha[:7]
+			}
+			line = strings.TrimSpace(sha + " " + e.Entry.Comment)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", position, e.Status, e.Entry.Action, label, line)
+	}
+	w.Flush()
+
+	if len(unmerged) > 0 {
+		fmt.Println("\nConflicting paths:")
+		for _, path := range unmerged {
+			fmt.Printf("  %v\n", path)
+		}
+	}
+	fmt.Println()
+	return nil
+}
+
+// rebasedCommits returns the stack as it was before the rebase, bottom to top.
+func (cli *stackCLI) rebasedCommits(state *stackState) ([]string, error) {
+	if state != nil {
+		return state.Commits, nil
+	}
+
+	origHeadPath, err := git.GetGitPath("rebase-merge/orig-head")
+	if err != nil {
+		return nil, err
+	}
+	origHead, err := ioutil.ReadFile(origHeadPath)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamName, err := upstreamWithFlag(cli.upstreamOverride)
+	if err != nil {
+		return nil, err
+	}
+	st, err := loadStackAt(upstreamName, strings.TrimSpace(string(origHead)))
+	if err != nil {
+		return nil, err
+	}
+	return st.Commits, nil
+}
+
+// readRebaseTodo reads one of the todo files of an interactive rebase, nil if it is missing.
+func readRebaseTodo(name string) (*rebasetodo.Todo, error) {
+	path, err := git.GetGitPath(name)
+	if err != nil {
+		return nil, err
+	}
+	todo, err := rebasetodo.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &rebasetodo.Todo{}, nil
+	}
+	return todo, err
+}
+
+// sameCommit compares two possibly abbreviated SHAs.
+func sameCommit(a, b string) bool {
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
@@ -0,0 +1,49 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func (cli *stackCLI) doSync(ctx *kingpin.ParseContext) error {
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	// Commits that already landed upstream will be dropped by the rebase.
+	landed, err := git.ListCherries(st.Upstream, "HEAD", st.Base)
+	clitools.UserError(err)
+
+	landedTitles := map[string]string{}
+	for _, sha := range landed {
+		landedTitles[sha], err = git.GetCommitWithFormat(sha, "%s")
+		clitools.UserError(err)
+	}
+
+	state, err := newStackState("sync", st)
+	clitools.UserError(err)
+	state.Relabel = relabelByPatchID
+	state.Removed = landed
+	clitools.UserError(state.save())
+
+	err = git.Cmd("rebase", st.Upstream).
+		PipeStdout(os.Stdout).PipeStderr(os.Stderr).
+		Run().Err()
+	state.check("Sync", err)
+
+	_, unmatched, err := state.finish()
+	clitools.UserError(err)
+
+	if len(landed) > 0 {
+		fmt.Println("\nDropped, already landed upstream:")
+		for _, sha := range landed {
+			fmt.Printf("  %v %v\n", sha[:7], landedTitles[sha])
+		}
+	}
+	reportUnmatched(unmatched)
+
+	return nil
+}
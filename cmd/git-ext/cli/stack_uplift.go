@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
+	"github.com/NonLogicalDev/cli.git-ext/lib/rebasetodo"
+	"github.com/NonLogicalDev/cli.git-ext/lib/shutils/git"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// doUplift moves a commit out of the stack onto the top of another branch, or of a new branch
+// started from the upstream. The commit keeps its message, so its metadata and revision go
+// with it, and it is labeled as the new top of the other stack.
+//
+// The other branch is updated first, so the commit is never lost if removing it from the
+// stack stops on a conflict.
+func (cli *stackCLI) doUplift(ctx *kingpin.ParseContext) error {
+	st, err := loadStack(cli.upstreamOverride)
+	clitools.UserError(err)
+
+	targetSha, err := st.findCommit(cli.upliftTargetRef)
+	clitools.UserError(err)
+
+	if branch, err := stackBranch(); err == nil && branch == cli.upliftTo {
+		clitools.UserErrorStr("Uplift", "%v is already on %v", targetSha[:7], cli.upliftTo)
+	}
+
+	toRef := "refs/heads/" + cli.upliftTo
+	toTip, err := git.GetSha(toRef)
+	create := err != nil
+	if create {
+		toTip, err = git.GetSha(st.Upstream)
+		clitools.UserError(err)
+	}
+
+	commit, err := git.GetCommit(targetSha)
+	clitools.UserError(err)
+	commit.Tree, err = git.PickTree(commit, toTip)
+	if _, ok := err.(*git.ConflictError); ok {
+		clitools.UserErrorStr("Uplift", "%v does not apply cleanly onto %v, nothing was changed", targetSha[:7], cli.upliftTo)
+	}
+	clitools.UserError(err)
+	commit.Parents = []string{toTip}
+
+	upliftedSha, err := git.CommitTree(commit)
+	clitools.UserError(err)
+
+	if create {
+		clitools.UserError(
+			git.Cmd("branch", "--quiet", "--track", cli.upliftTo, st.Upstream).
+				PipeStderr(os.Stderr).
+				Run().Err(),
+		)
+		fmt.Printf("Created %v from %v\n", cli.upliftTo, st.Upstream)
+	}
+	clitools.UserError(git.UpdateRef(toRef, upliftedSha, toTip, "git-ext: stack uplift "+targetSha[:7]))
+	fmt.Printf("Uplifted %v -> %v onto %v\n", targetSha[:7], upliftedSha[:7], cli.upliftTo)
+
+	// A branch without an upstream is taken to be on the same upstream as the stack.
+	toSt, err := loadBranchStack("", cli.upliftTo)
+	if err != nil {
+		toSt, err = loadStackAt(st.Upstream, toRef)
+	}
+	clitools.UserError(err)
+	// Without per branch labels both stacks share the same labels, the other one is left to
+	// be labeled once checked out.
+	scheme, err := currentLabelScheme()
+	clitools.UserError(err)
+	if toScheme := labelSchemeFor(cli.upliftTo); toScheme != scheme {
+		label := toScheme.name(len(toSt.Commits))
+		fmt.Printf("Labeling %v as %v\n", upliftedSha[:7], label)
+		clitools.UserError(toScheme.set(label, upliftedSha))
+	} else {
+		fmt.Printf("Run `git-ext stack label` on %v to label it, labels are not kept per branch\n", cli.upliftTo)
+	}
+
+	var remaining []string
+	for _, sha := range st.Commits {
+		if sha != targetSha {
+			remaining = append(remaining, sha)
+		}
+	}
+
+	rewritten, err := replayStack(st, remaining, nil, "stack uplift "+targetSha[:7])
+	if _, ok := err.(*git.ConflictError); ok {
+		cli.upliftInWorktree(st, targetSha)
+		return nil
+	}
+	clitools.UserError(err)
+	clitools.UserError(scheme.move(rewritten, []string{targetSha}))
+	return nil
+}
+
+// upliftInWorktree removes the uplifted commit from the stack with a rebase, for when the
+// commits above it do not replay cleanly without it.
+func (cli *stackCLI) upliftInWorktree(st *stack, targetSha string) {
+	state, err := newStackState("uplift", st)
+	clitools.UserError(err)
+	state.Removed = []string{targetSha}
+	clitools.UserError(state.save())
+
+	err = cli.startTodoRebase(targetSha, todoRewrite{Action: rebasetodo.Drop})
+	state.check("Uplift", err)
+
+	_, _, err = state.finish()
+	clitools.UserError(err)
+}
@@ -24,6 +24,7 @@ func setUpParser() *kingpin.Application {
 	cli.RegisterStackCLI(cliParser)
 	cli.RegisterPhabCLI(cliParser)
 	cli.RegisterMetaCLI(cliParser)
+	cli.RegisterOplogCLI(cliParser)
 
 	return cliParser
 }
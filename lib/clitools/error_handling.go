@@ -12,13 +12,13 @@ func UserErrorStr(t, msg string, args ...interface{}) {
 
 func UserError(err error) {
 	if err != nil {
-		UserErrorStr("Go", err.Error())
+		UserErrorStr("Go", "%v", err.Error())
 	}
 }
 
 func UserErrorWrap(err error, format string, args ...interface{}) {
 	if err != nil {
-		UserErrorStr("Go", fmt.Sprintf("%v |%v:", err.Error(), fmt.Sprintf(format, args...)))
+		UserErrorStr("Go", "%v |%v:", err.Error(), fmt.Sprintf(format, args...))
 	}
 }
 
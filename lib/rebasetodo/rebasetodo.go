@@ -0,0 +1,263 @@
+// Package rebasetodo reads and writes the todo list git hands to the sequence editor during an
+// interactive rebase (git-rebase-todo). Lines that are not modified are written back exactly as
+// they were read.
+package rebasetodo
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+// Actions, by their long names. Abbreviated actions are expanded when parsing.
+const (
+	Pick      = "pick"
+	Reword    = "reword"
+	Edit      = "edit"
+	Squash    = "squash"
+	Fixup     = "fixup"
+	Exec      = "exec"
+	Break     = "break"
+	Drop      = "drop"
+	Label     = "label"
+	Reset     = "reset"
+	Merge     = "merge"
+	UpdateRef = "update-ref"
+	Noop      = "noop"
+)
+
+var abbreviations = map[string]string{
+	"p": Pick,
+	"r": Reword,
+	"e": Edit,
+	"s": Squash,
+	"f": Fixup,
+	"x": Exec,
+	"b": Break,
+	"d": Drop,
+	"l": Label,
+	"t": Reset,
+	"m": Merge,
+	"u": UpdateRef,
+}
+
+// Entry is a single line of the todo list.
+//
+// Comments and blank lines have an empty Action and keep their text in Comment.
+//
+//	pick|reword|edit|squash|drop <Commit> <Comment>
+//	fixup [<Option>] <Commit> <Comment>           Option: -C, -c
+//	merge [<Option> <Commit>] <Arg> <Comment>      Option: -C, -c; Arg: one or more labels
+//	label|reset|update-ref <Arg> <Comment>
+//	exec <Arg>
+//	break|noop <Comment>
+type Entry struct {
+	Action  string
+	Option  string
+	Commit  string
+	Arg     string
+	Comment string
+
+	raw    string
+	parsed [5]string
+}
+
+// NewEntry creates an entry that applies action to a commit, the subject is written out after
+// the commit as a comment.
+func NewEntry(action string, commit string, subject string) *Entry {
+	return &Entry{Action: action, Commit: commit, Comment: subject}
+}
+
+// NewExec creates an entry running a shell command.
+func NewExec(command string) *Entry {
+	return &Entry{Action: Exec, Arg: command}
+}
+
+// IsCommit reports whether the entry applies a single commit.
+func (e *Entry) IsCommit() bool {
+	switch e.Action {
+	case Pick, Reword, Edit, Squash, Fixup, Drop:
+		return true
+	}
+	return false
+}
+
+// String renders the entry as a todo line.
+func (e *Entry) String() string {
+	if e.fields() == e.parsed {
+		return e.raw
+	}
+	if e.Action == "" {
+		return e.Comment
+	}
+
+	parts := []string{e.Action}
+	for _, part := range []string{e.Option, e.Commit, e.Arg, e.Comment} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (e *Entry) fields() [5]string {
+	return [5]string{e.Action, e.Option, e.Commit, e.Arg, e.Comment}
+}
+
+// Todo is a parsed todo list.
+type Todo struct {
+	Entries []*Entry
+
+	trailingNewline bool
+}
+
+// ReadFile parses the todo list stored in file.
+func ReadFile(file string) (*Todo, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(string(raw)), nil
+}
+
+// WriteFile replaces the content of file with the todo list.
+func (t *Todo) WriteFile(file string) error {
+	return ioutil.WriteFile(file, []byte(t.String()), 0666)
+}
+
+// Parse parses a todo list, lines starting with '#' are treated as comments. Unknown actions
+// are kept as they are, with everything after the action in Arg.
+func Parse(data string) *Todo {
+	t := &Todo{}
+	if strings.HasSuffix(data, "\n") {
+		t.trailingNewline = true
+		data = strings.TrimSuffix(data, "\n")
+	}
+	if data == "" {
+		return t
+	}
+
+	for _, line := range strings.Split(data, "\n") {
+		t.Entries = append(t.Entries, parseLine(line))
+	}
+	return t
+}
+
+func parseLine(line string) *Entry {
+	e := &Entry{raw: line}
+	defer func() { e.parsed = e.fields() }()
+
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+		e.Comment = line
+		return e
+	}
+
+	action, rest := cut(trimmed)
+	if long, ok := abbreviations[action]; ok {
+		action = long
+	}
+	e.Action = action
+
+	switch action {
+	case Pick, Reword, Edit, Squash, Drop:
+		e.Commit, e.Comment = cut(rest)
+	case Fixup:
+		if strings.HasPrefix(rest, "-C ") || strings.HasPrefix(rest, "-c ") {
+			e.Option, rest = cut(rest)
+		}
+		e.Commit, e.Comment = cut(rest)
+	case Merge:
+		if strings.HasPrefix(rest, "-C ") || strings.HasPrefix(rest, "-c ") {
+			e.Option, rest = cut(rest)
+			e.Commit, rest = cut(rest)
+		}
+		if idx := strings.Index(rest, "#"); idx >= 0 {
+			e.Arg, e.Comment = strings.TrimSpace(rest[:idx]), rest[idx:]
+		} else {
+			e.Arg = rest
+		}
+	case Label, Reset, UpdateRef:
+		e.Arg, e.Comment = cut(rest)
+	case Break, Noop:
+		e.Comment = rest
+	default:
+		e.Arg = rest
+	}
+	return e
+}
+
+// cut splits s at the first run of whitespace.
+func cut(s string) (string, string) {
+	idx := strings.IndexAny(s, " \t")
+	if idx < 0 {
+		return s, ""
+	}
+	return s[:idx], strings.TrimLeft(s[idx:], " \t")
+}
+
+// String renders the todo list.
+func (t *Todo) String() string {
+	lines := make([]string, len(t.Entries))
+	for idx, e := range t.Entries {
+		lines[idx] = e.String()
+	}
+
+	out := strings.Join(lines, "\n")
+	if t.trailingNewline {
+		out += "\n"
+	}
+	return out
+}
+
+// Commands returns the entries that are not comments or blank lines.
+func (t *Todo) Commands() []*Entry {
+	var commands []*Entry
+	for _, e := range t.Entries {
+		if e.Action != "" {
+			commands = append(commands, e)
+		}
+	}
+	return commands
+}
+
+// Find returns the index of the first commit entry whose commit starts with prefix, or -1.
+func (t *Todo) Find(prefix string) int {
+	if prefix == "" {
+		return -1
+	}
+	for idx, e := range t.Entries {
+		if e.IsCommit() && strings.HasPrefix(e.Commit, prefix) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// Insert inserts entries before the entry at index idx.
+func (t *Todo) Insert(idx int, entries ...*Entry) {
+	result := make([]*Entry, 0, len(t.Entries)+len(entries))
+	result = append(result, t.Entries[:idx]...)
+	result = append(result, entries...)
+	result = append(result, t.Entries[idx:]...)
+	t.Entries = result
+}
+
+// Move moves the entry at index from to just before, or just after, the entry at index anchor.
+func (t *Todo) Move(from int, anchor int, after bool) {
+	entry := t.Entries[from]
+
+	var result []*Entry
+	for idx, e := range t.Entries {
+		if idx == from {
+			continue
+		}
+		if idx == anchor && !after {
+			result = append(result, entry)
+		}
+		result = append(result, e)
+		if idx == anchor && after {
+			result = append(result, entry)
+		}
+	}
+	t.Entries = result
+}
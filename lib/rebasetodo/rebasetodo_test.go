@@ -0,0 +1,96 @@
+package rebasetodo
+
+import (
+	"testing"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		entry Entry
+	}{
+		{"pick 1a2b3c4 Add feature", Entry{Action: Pick, Commit: "1a2b3c4", Comment: "Add feature"}},
+		{"p 1a2b3c4 Add feature", Entry{Action: Pick, Commit: "1a2b3c4", Comment: "Add feature"}},
+		{"f 1a2b3c4 fixup! Add feature", Entry{Action: Fixup, Commit: "1a2b3c4", Comment: "fixup! Add feature"}},
+		{"s 1a2b3c4 squash! Add feature", Entry{Action: Squash, Commit: "1a2b3c4", Comment: "squash! Add feature"}},
+		{"fixup -C 1a2b3c4 amend! Add feature", Entry{Action: Fixup, Option: "-C", Commit: "1a2b3c4", Comment: "amend! Add feature"}},
+		{"fixup -c 1a2b3c4 amend! Add feature", Entry{Action: Fixup, Option: "-c", Commit: "1a2b3c4", Comment: "amend! Add feature"}},
+		{"drop 1a2b3c4", Entry{Action: Drop, Commit: "1a2b3c4"}},
+		{
+			"merge -C 1a2b3c4 topic # Merge branch 'topic'",
+			Entry{Action: Merge, Option: "-C", Commit: "1a2b3c4", Arg: "topic", Comment: "# Merge branch 'topic'"},
+		},
+		{"merge topic-a topic-b", Entry{Action: Merge, Arg: "topic-a topic-b"}},
+		{"label onto", Entry{Action: Label, Arg: "onto"}},
+		{"reset onto", Entry{Action: Reset, Arg: "onto"}},
+		{"update-ref refs/heads/topic", Entry{Action: UpdateRef, Arg: "refs/heads/topic"}},
+		{"exec make test # run the tests", Entry{Action: Exec, Arg: "make test # run the tests"}},
+		{"x echo '#1'", Entry{Action: Exec, Arg: "echo '#1'"}},
+		{"break", Entry{Action: Break}},
+		{"noop", Entry{Action: Noop}},
+		{"", Entry{}},
+		{"# Rebase 1a2b3c4..5d6e7f8 onto 1a2b3c4", Entry{Comment: "# Rebase 1a2b3c4..5d6e7f8 onto 1a2b3c4"}},
+		{"  # indented comment", Entry{Comment: "  # indented comment"}},
+		{"frobnicate a b", Entry{Action: "frobnicate", Arg: "a b"}},
+	}
+
+	for _, test := range tests {
+		e := parseLine(test.line)
+		if e.fields() != test.entry.fields() {
+			t.Errorf("parseLine(%q) = %q, want %q", test.line, e.fields(), test.entry.fields())
+		}
+		if e.String() != test.line {
+			t.Errorf("parseLine(%q).String() = %q, want the line unchanged", test.line, e.String())
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"single line without newline", "pick 1a2b3c4 Add feature"},
+		{"trailing line without newline", "pick 1a2b3c4 Add feature\nf  5d6e7f8   fixup! Add feature"},
+		{"blank lines", "pick 1a2b3c4 Add feature\n\n\nbreak\n"},
+		{
+			"comment block",
+			"p 1a2b3c4 Add feature\n\n# Rebase 1a2b3c4..5d6e7f8 onto 1a2b3c4 (1 command)\n#\n# Commands:\n# p, pick <commit> = use commit\n",
+		},
+		{
+			"rebase merges",
+			"label onto\n\nreset onto\npick 1a2b3c4 Add feature\nlabel topic\n\nreset onto\n" +
+				"merge -C 5d6e7f8 topic # Merge branch 'topic'\nupdate-ref refs/heads/topic\n",
+		},
+		{"exec with hash", "pick 1a2b3c4 Add feature\nexec make test # run the tests\n"},
+		{"tabs", "pick\t1a2b3c4\tAdd feature\n"},
+	}
+
+	for _, test := range tests {
+		if out := Parse(test.data).String(); out != test.data {
+			t.Errorf("%v: round trip = %q, want %q", test.name, out, test.data)
+		}
+	}
+}
+
+func TestModifiedEntries(t *testing.T) {
+	todo := Parse("p 1a2b3c4 Add feature\nfixup -C 5d6e7f8 amend! Add feature\npick 9a8b7c6 Add tests\n# comment\n")
+
+	todo.Entries[0].Action = Edit
+	todo.Entries[1].Action = Fixup
+	todo.Entries[1].Option = ""
+	todo.Insert(3, NewExec("make test"))
+	todo.Move(2, 0, false)
+
+	want := "pick 9a8b7c6 Add tests\nedit 1a2b3c4 Add feature\nfixup 5d6e7f8 amend! Add feature\nexec make test\n# comment\n"
+	if out := todo.String(); out != want {
+		t.Errorf("String() = %q, want %q", out, want)
+	}
+	if idx := todo.Find("5d6e"); idx != 2 {
+		t.Errorf("Find(5d6e) = %d, want 2", idx)
+	}
+	if n := len(todo.Commands()); n != 4 {
+		t.Errorf("len(Commands()) = %d, want 4", n)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/NonLogicalDev/cli.git-ext/lib/clitools"
 	shutils "github.com/NonLogicalDev/nld.lib.go.shutils"
@@ -24,11 +25,20 @@ func Cmd(args ...interface{}) *shutils.ShCMD {
 }
 
 func RevisionFromMessage(message string) string {
+	rev := FindRevision(message)
+	if len(rev) == 0 {
+		return "No Revision"
+	}
+	return rev
+}
+
+// FindRevision returns the Differential Revision referenced in the message, or an empty string.
+func FindRevision(message string) string {
 	groups := PhabDiffRe.FindStringSubmatch(message)
 	if len(groups) == 0 {
-		return "No Revision"
+		return ""
 	}
-	return groups[1]
+	return strings.TrimSpace(groups[1])
 }
 
 func Diff(base, updateRevision string, extArgs []string) error {
@@ -1,7 +1,10 @@
 package git
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"strings"
 
 	shutils "github.com/NonLogicalDev/nld.lib.go.shutils"
@@ -11,6 +14,24 @@ func GetUpstream() (string, error) {
 	return RawGetAbbrevRef("@{upstream}").Run().Value()
 }
 
+func GetUpstreamOf(branch string) (string, error) {
+	return RawGetAbbrevRef(branch + "@{upstream}").Run().Value()
+}
+
+// GetCurrentBranch returns the short name of the checked out branch, it fails when HEAD is detached.
+func GetCurrentBranch() (string, error) {
+	return Cmd("symbolic-ref", "--short", "-q", "HEAD").Run().Value()
+}
+
+// ListBranchesContaining returns the short names of local branches that contain the commit.
+func ListBranchesContaining(ref string) ([]string, error) {
+	listStr, err := Cmd("for-each-ref", "--contains", ref, "--format=%(refname:short)", "refs/heads/").Run().Value()
+	if err != nil {
+		return nil, err
+	}
+	return splitLines(listStr), nil
+}
+
 func GetRoot() (string, error) {
 	return RawGetRoot().Run().Value()
 }
@@ -28,7 +49,16 @@ func ListObjectsInRange(refA, refB string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	return strings.Split(listStr, "\n"), nil
+	return splitLines(listStr), nil
+}
+
+// ListCommitFiles returns the paths changed by the commit relative to its first parent.
+func ListCommitFiles(sha string) ([]string, error) {
+	listStr, err := Cmd("diff-tree", "--no-commit-id", "--name-only", "-r", "--root", sha).Run().Value()
+	if err != nil {
+		return nil, err
+	}
+	return splitLines(listStr), nil
 }
 
 func ListBranches() ([]string, error) {
@@ -36,7 +66,7 @@ func ListBranches() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	return strings.Split(listStr, "\n"), nil
+	return splitLines(listStr), nil
 }
 
 func GetCommitWithFormat(sha, format string) (string, error) {
@@ -47,6 +77,121 @@ func GetCommitWithFormat(sha, format string) (string, error) {
 	return message, err
 }
 
+// Commit holds the parts of a commit object needed to recreate it elsewhere.
+type Commit struct {
+	SHA     string
+	Tree    string
+	Parents []string
+
+	AuthorName  string
+	AuthorEmail string
+	AuthorDate  string
+
+	Message string
+}
+
+func GetCommit(ref string) (*Commit, error) {
+	var out bytes.Buffer
+	err := Cmd("show", "--no-patch", "--format=%H%x00%T%x00%P%x00%an%x00%ae%x00%aI%x00%B", ref).
+		PipeStdout(&out).
+		Run().Err()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(out.String(), "\x00", 7)
+	if len(parts) != 7 {
+		return nil, fmt.Errorf("unexpected commit format for %v", ref)
+	}
+
+	return &Commit{
+		SHA:         parts[0],
+		Tree:        parts[1],
+		Parents:     strings.Fields(parts[2]),
+		AuthorName:  parts[3],
+		AuthorEmail: parts[4],
+		AuthorDate:  parts[5],
+		Message:     strings.TrimRight(parts[6], "\n") + "\n",
+	}, nil
+}
+
+// CommitTree writes a new commit object from the tree, parents, author and message of the
+// commit, the committer being the current user. It returns the SHA of the new commit.
+func CommitTree(commit *Commit) (string, error) {
+	args := []interface{}{"commit-tree", commit.Tree}
+	for _, parent := range commit.Parents {
+		args = append(args, "-p", parent)
+	}
+	args = append(args, "-F", "-")
+
+	cmd := Cmd(args...).PipeStdin(strings.NewReader(commit.Message))
+	cmd.X.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+commit.AuthorName,
+		"GIT_AUTHOR_EMAIL="+commit.AuthorEmail,
+		"GIT_AUTHOR_DATE="+commit.AuthorDate,
+	)
+	return cmd.Run().Value()
+}
+
+// WriteIndexTree writes the staged content of the index as a tree and returns its SHA.
+func WriteIndexTree() (string, error) {
+	return Cmd("write-tree").Run().Value()
+}
+
+// UpdateRef points the ref at newSha, failing if it no longer points at oldSha.
+func UpdateRef(ref, newSha, oldSha, reason string) error {
+	return Cmd("update-ref", "-m", reason, ref, newSha, oldSha).Run().Err()
+}
+
+// AddTrailer adds the trailer to the message unless a trailer with the same key exists.
+func AddTrailer(message, key, value string) (string, error) {
+	out, err := Cmd("interpret-trailers", "--if-exists", "doNothing", "--trailer", fmt.Sprintf("%v: %v", key, value)).
+		PipeStdin(strings.NewReader(message)).
+		Run().Value()
+	if err != nil {
+		return "", err
+	}
+	return out + "\n", nil
+}
+
+// CleanupMessage normalizes whitespace in a commit message the same way `git commit` does,
+// optionally also removing comment lines as after editing the message.
+func CleanupMessage(message string, stripComments bool) (string, error) {
+	args := []interface{}{"stripspace"}
+	if stripComments {
+		args = append(args, "--strip-comments")
+	}
+	out, err := Cmd(args...).PipeStdin(strings.NewReader(message)).Run().Value()
+	if err != nil {
+		return "", err
+	}
+	return out + "\n", nil
+}
+
+// EditFile opens the file in the editor configured for git, waiting for it to be closed.
+func EditFile(file string) error {
+	editor, err := Cmd("var", "GIT_EDITOR").Run().Value()
+	if err != nil {
+		return err
+	}
+	return shutils.Cmd("sh", "-c", editor+` "$@"`, editor, file).
+		PipeStdin(os.Stdin).PipeStdout(os.Stdout).PipeStderr(os.Stderr).
+		Run().Err()
+}
+
+func GetConfig(key string) (string, error) {
+	return Cmd("config", "--get", key).Run().Value()
+}
+
+// GetConfigBool reads a boolean config value, falling back to the default when it is not set.
+func GetConfigBool(key string, fallback bool) bool {
+	value, err := Cmd("config", "--type=bool", "--get", key).Run().Value()
+	if err != nil || value == "" {
+		return fallback
+	}
+	return value == "true"
+}
+
 func GetSymbolicRefsForSHA(sha string) ([]string, error) {
 	listStr, err := Cmd("for-each-ref", "--points-at", sha, "--format", "%(refname:short)").Run().Value()
 	if err != nil {
@@ -56,6 +201,221 @@ func GetSymbolicRefsForSHA(sha string) ([]string, error) {
 	return strings.Split(listStr, "\n"), nil
 }
 
+// ListRefs returns a map of full ref names matching the pattern to the SHA they point at.
+func ListRefs(pattern string) (map[string]string, error) {
+	listStr, err := RawListRefs(pattern).Run().Value()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := map[string]string{}
+	for _, line := range splitLines(listStr) {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 {
+			refs[parts[1]] = parts[0]
+		}
+	}
+	return refs, nil
+}
+
+func GetCommitShortStat(sha string) (string, error) {
+	return RawGetCommitShortStat(sha).Run().Value()
+}
+
+// GetPatchIDs maps every commit in the range to its stable patch-id. Commits without
+// changes have no patch-id and are omitted.
+func GetPatchIDs(refA, refB string) (map[string]string, error) {
+	var patches bytes.Buffer
+	err := RawLogPatches(refA, refB).PipeStdout(&patches).Run().Err()
+	if err != nil {
+		return nil, err
+	}
+
+	listStr, err := RawPatchID().PipeStdin(&patches).Run().Value()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := map[string]string{}
+	for _, line := range splitLines(listStr) {
+		parts := strings.Fields(line)
+		if len(parts) == 2 {
+			ids[parts[1]] = parts[0]
+		}
+	}
+	return ids, nil
+}
+
+// ListCherries returns the commits in the range that already have an equivalent change
+// (same patch-id) in upstream.
+func ListCherries(upstream, head, limit string) ([]string, error) {
+	listStr, err := Cmd("cherry", upstream, head, limit).Run().Value()
+	if err != nil {
+		return nil, err
+	}
+
+	var shas []string
+	for _, line := range splitLines(listStr) {
+		if strings.HasPrefix(line, "- ") {
+			shas = append(shas, strings.TrimPrefix(line, "- "))
+		}
+	}
+	return shas, nil
+}
+
+func IsRebaseInProgress() bool {
+	for _, dir := range []string{"rebase-merge", "rebase-apply"} {
+		path, err := GetGitPath(dir)
+		if err != nil {
+			return false
+		}
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// GetRebaseHeadName returns the short name of the branch an ongoing rebase is rewriting.
+func GetRebaseHeadName() (string, error) {
+	for _, dir := range []string{"rebase-merge", "rebase-apply"} {
+		path, err := GetGitPath(dir + "/head-name")
+		if err != nil {
+			return "", err
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err == nil {
+			return strings.TrimPrefix(strings.TrimSpace(string(raw)), "refs/heads/"), nil
+		}
+	}
+	return "", fmt.Errorf("no rebase in progress")
+}
+
+// GetRebaseEditStop returns the SHA, possibly abbreviated, of the commit an ongoing rebase
+// stopped at to be edited. It is empty when the rebase is not stopped at an edit.
+func GetRebaseEditStop() (string, error) {
+	var parts []string
+	for _, name := range []string{"rebase-merge/stopped-sha", "rebase-merge/amend"} {
+		path, err := GetGitPath(name)
+		if err != nil {
+			return "", err
+		}
+		raw, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+		parts = append(parts, strings.TrimSpace(string(raw)))
+	}
+
+	head, err := GetSha("HEAD")
+	if err != nil || parts[1] != head {
+		return "", err
+	}
+	return parts[0], nil
+}
+
+// ListUnmergedFiles lists the paths with unresolved conflicts in the index.
+func ListUnmergedFiles() ([]string, error) {
+	out, err := Cmd("diff", "--name-only", "--diff-filter=U").Run().Value()
+	if err != nil {
+		return nil, err
+	}
+	return splitLines(out), nil
+}
+
+// GetGitPath resolves a path inside of the git directory, the same way `git rev-parse --git-path` does.
+func GetGitPath(name string) (string, error) {
+	return Cmd("rev-parse", "--path-format=absolute", "--git-path", name).Run().Value()
+}
+
+// BlameLines attributes the given lines of a file at the head of the range to the commits
+// in the range that last changed them. Lines coming from outside of the range are omitted.
+func BlameLines(refA, refB, path string, lines []int) (map[int]string, error) {
+	args := []interface{}{"blame", "--porcelain", fmt.Sprintf("%v..%v", refA, refB)}
+	for _, line := range lines {
+		args = append(args, "-L", fmt.Sprintf("%d,%d", line, line))
+	}
+	args = append(args, "--", path)
+
+	hashLength, err := GetHashLength()
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := Cmd(args...).PipeStdout(&out).Run().Err(); err != nil {
+		return nil, err
+	}
+
+	owners := map[int]string{}
+	boundary := map[string]bool{}
+	var sha string
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "\t"):
+			continue
+		case len(fields) >= 3 && isHash(fields[0], hashLength):
+			sha = fields[0]
+			var finalLine int
+			fmt.Sscanf(fields[2], "%d", &finalLine)
+			owners[finalLine] = sha
+		case line == "boundary":
+			boundary[sha] = true
+		}
+	}
+
+	for line, owner := range owners {
+		if boundary[owner] {
+			delete(owners, line)
+		}
+	}
+	return owners, nil
+}
+
+// GetHashLength returns the length of object names in the repository, 40 for sha1 and 64 for
+// sha256 repositories.
+func GetHashLength() (int, error) {
+	format, err := Cmd("rev-parse", "--show-object-format").Run().Value()
+	if err != nil {
+		return 0, err
+	}
+	switch format {
+	case "sha1":
+		return 40, nil
+	case "sha256":
+		return 64, nil
+	}
+	return 0, fmt.Errorf("unknown object format %q", format)
+}
+
+// isHash reports whether s is a full object name of the given length.
+func isHash(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// GetCommonDir returns the absolute path of the git directory shared by all worktrees.
+func GetCommonDir() (string, error) {
+	return Cmd("rev-parse", "--path-format=absolute", "--git-common-dir").Run().Value()
+}
+
+func splitLines(str string) []string {
+	if len(str) == 0 {
+		return nil
+	}
+	return strings.Split(str, "\n")
+}
+
 /*
 	Raw Command Helpers
 */
@@ -64,6 +424,25 @@ func Cmd(args ...interface{}) *shutils.ShCMD {
 	return shutils.Cmd("git", args...)
 }
 
+// CmdWithIndex is like Cmd, but the command operates on a separate index file.
+func CmdWithIndex(indexFile string, args ...interface{}) *shutils.ShCMD {
+	cmd := Cmd(args...)
+	cmd.X.Env = append(os.Environ(), "GIT_INDEX_FILE="+indexFile)
+	return cmd
+}
+
+// RebaseCmd runs `git rebase` with the editor, and the sequence editor when given, replaced so
+// that it runs without prompting. The rest of the environment is kept, as the commits created
+// by the rebase need the identity, config and hooks of the user.
+func RebaseCmd(sequenceEditor string, args ...interface{}) *shutils.ShCMD {
+	cmd := Cmd(append([]interface{}{"rebase"}, args...)...)
+	cmd.X.Env = append(os.Environ(), "GIT_EDITOR=true", "LANG=en_US.UTF-8")
+	if sequenceEditor != "" {
+		cmd.X.Env = append(cmd.X.Env, "GIT_SEQUENCE_EDITOR="+sequenceEditor)
+	}
+	return cmd
+}
+
 func RawGetRoot() *shutils.ShCMD {
 	return Cmd("rev-parse", "--show-toplevel")
 }
@@ -92,6 +471,22 @@ func RawGetCommitStat(ref string) *shutils.ShCMD {
 	return Cmd("show", "--oneline", "--stat", ref)
 }
 
+func RawGetCommitShortStat(ref string) *shutils.ShCMD {
+	return Cmd("show", "--shortstat", "--format=", ref)
+}
+
+func RawLogPatches(refA, refB string) *shutils.ShCMD {
+	return Cmd("log", "-p", "--no-color", "--no-ext-diff", "--no-merges", fmt.Sprintf("%v..%v", refA, refB))
+}
+
+func RawPatchID() *shutils.ShCMD {
+	return Cmd("patch-id", "--stable")
+}
+
+func RawListRefs(pattern string) *shutils.ShCMD {
+	return Cmd("for-each-ref", "--format=%(objectname) %(refname)", pattern)
+}
+
 func RawListBranches() *shutils.ShCMD {
 	return Cmd("branch", "--list", "-a", "--format=%(refname:short)")
 }
@@ -109,6 +504,14 @@ func RawSetBranch(ref, name string, force bool) *shutils.ShCMD {
 	return Cmd(args...)
 }
 
+func RawSetRef(ref, sha string) *shutils.ShCMD {
+	return Cmd("update-ref", "--create-reflog", ref, sha)
+}
+
+func RawDeleteRef(ref string) *shutils.ShCMD {
+	return Cmd("update-ref", "-d", ref)
+}
+
 func RawUnSetBranch(name string, force bool) *shutils.ShCMD {
 	var args = []interface{}{
 		"branch", "--create-reflog", "-D",
@@ -0,0 +1,134 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConflictError is returned when a commit can not be replayed in the object database because
+// its changes conflict with the new parent. The rewrite has to be done in a worktree instead.
+type ConflictError struct {
+	SHA string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v does not apply cleanly", e.SHA[:7])
+}
+
+// Replay recreates the commits, oldest first, one on top of the other starting from onto. It
+// only writes objects, so neither the working tree nor any ref is touched. Leaving a commit
+// out of the list drops it, reordering the list reorders the commits, and the edit callback,
+// when given, can change each commit before it is written. A changed tree is taken as the
+// new content of the commit, relative to its original parent.
+//
+// It returns the new SHAs keyed by the original ones, only for the commits that changed, and
+// the tip of the replayed commits.
+func Replay(onto string, commits []string, edit func(commit *Commit) error) (map[string]string, string, error) {
+	rewritten := map[string]string{}
+	parent := onto
+
+	for _, sha := range commits {
+		commit, err := GetCommit(sha)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(commit.Parents) != 1 {
+			return nil, "", fmt.Errorf("can not replay merge commit %v", sha[:7])
+		}
+
+		originalMessage, originalTree := commit.Message, commit.Tree
+		if edit != nil {
+			if err := edit(commit); err != nil {
+				return nil, "", err
+			}
+		}
+
+		if commit.Parents[0] == parent && commit.Message == originalMessage && commit.Tree == originalTree {
+			parent = sha
+			continue
+		}
+
+		commit.Tree, err = PickTree(commit, parent)
+		if err != nil {
+			return nil, "", err
+		}
+		commit.Parents = []string{parent}
+
+		parent, err = CommitTree(commit)
+		if err != nil {
+			return nil, "", err
+		}
+		rewritten[sha] = parent
+	}
+
+	return rewritten, parent, nil
+}
+
+// PickTree computes the tree resulting from applying the changes of the commit on top of onto,
+// the same way cherry-pick would. It fails with a ConflictError if the changes do not apply
+// cleanly.
+func PickTree(commit *Commit, onto string) (string, error) {
+	parentTree, err := GetSha(commit.Parents[0] + "^{tree}")
+	if err != nil {
+		return "", err
+	}
+	ontoTree, err := GetSha(onto + "^{tree}")
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case parentTree == ontoTree:
+		return commit.Tree, nil
+	case parentTree == commit.Tree:
+		return ontoTree, nil
+	}
+
+	// merge-tree picks the merge base itself, so both sides are given a throwaway root commit
+	// with the tree of the original parent to force it to be the base.
+	base, err := Cmd("commit-tree", parentTree, "-m", "git-ext: merge base").Run().Value()
+	if err != nil {
+		return "", err
+	}
+	ours, err := Cmd("commit-tree", ontoTree, "-p", base, "-m", "git-ext: ours").Run().Value()
+	if err != nil {
+		return "", err
+	}
+	theirs, err := Cmd("commit-tree", commit.Tree, "-p", base, "-m", "git-ext: theirs").Run().Value()
+	if err != nil {
+		return "", err
+	}
+
+	cmd := Cmd("merge-tree", "--write-tree", "--no-messages", ours, theirs).Run()
+	if cmd.Err() != nil {
+		if state := cmd.State(); state != nil && state.ExitCode() == 1 {
+			return "", &ConflictError{SHA: commit.SHA}
+		}
+		return "", cmd.Err()
+	}
+
+	out, _ := cmd.Value()
+	return strings.SplitN(out, "\n", 2)[0], nil
+}
+
+// UpdateHead points HEAD at newSha, failing if it no longer points at oldSha. When the trees
+// of the two commits differ the working tree is updated as by checkout, keeping local changes
+// that do not overlap with the update.
+func UpdateHead(newSha, oldSha, reason string) error {
+	oldTree, err := GetSha(oldSha + "^{tree}")
+	if err != nil {
+		return err
+	}
+	newTree, err := GetSha(newSha + "^{tree}")
+	if err != nil {
+		return err
+	}
+
+	if oldTree != newTree {
+		err := Cmd("read-tree", "-m", "-u", oldSha, newSha).Run().Err()
+		if err != nil {
+			return err
+		}
+	}
+	return UpdateRef("HEAD", newSha, oldSha, reason)
+}